@@ -0,0 +1,184 @@
+// Package capture records message streams with their timing, so they can be
+// replayed through a sender. A capture file is a header followed by one
+// record per message, all little-endian:
+//
+//	offset  size  field
+//	0       4     magic "GRCP"
+//	4       1     version
+//
+// and for every record:
+//
+//	offset  size  field
+//	0       8     arrival time, unix nanoseconds
+//	8       4     message length n
+//	12      n     message
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go-relay/cmd/conf"
+	"go-relay/envelope"
+	"io"
+	"os"
+)
+
+const (
+	Magic   uint32 = 0x50435247 // "GRCP" on the wire
+	Version uint8  = 1
+
+	// MaxMessageSize bounds the length of a record read back.
+	MaxMessageSize = 16 << 20
+
+	headerSize       = 5
+	recordHeaderSize = 12
+)
+
+var (
+	ErrMagic   = errors.New("capture: bad magic")
+	ErrVersion = errors.New("capture: unsupported version")
+	ErrLength  = errors.New("capture: message too long")
+)
+
+// Record is a captured message and when it arrived.
+type Record struct {
+	Time    int64 // unix nanoseconds
+	Message []byte
+}
+
+// Payload returns the payload of an envelope, or the whole message for
+// traffic captured from elsewhere.
+func (r Record) Payload() []byte {
+	e, err := envelope.Decode(r.Message)
+	if err != nil {
+		return r.Message
+	}
+	return e.Payload
+}
+
+// Writer appends records to a capture. It buffers; call Flush when done.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter starts a capture on w by writing its header.
+func NewWriter(w io.Writer) (*Writer, error) {
+	var hdr [headerSize]byte
+	binary.LittleEndian.PutUint32(hdr[0:], Magic)
+	hdr[4] = Version
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return &Writer{w: bw}, nil
+}
+
+func (w *Writer) Write(r Record) error {
+	var hdr [recordHeaderSize]byte
+	binary.LittleEndian.PutUint64(hdr[0:], uint64(r.Time))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(r.Message)))
+
+	if _, err := w.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(r.Message)
+	return err
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// Reader reads the records of a capture in order.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader checks the header of the capture in r.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	var hdr [headerSize]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(hdr[0:]) != Magic {
+		return nil, ErrMagic
+	}
+	if hdr[4] != Version {
+		return nil, fmt.Errorf("%w %d", ErrVersion, hdr[4])
+	}
+	return &Reader{r: br}, nil
+}
+
+// Read returns the next record, or io.EOF after the last one. A capture cut
+// off inside a record ends with io.ErrUnexpectedEOF.
+func (r *Reader) Read() (Record, error) {
+	var hdr [recordHeaderSize]byte
+	if _, err := io.ReadFull(r.r, hdr[:]); err != nil {
+		return Record{}, err
+	}
+
+	n := binary.LittleEndian.Uint32(hdr[8:])
+	if n > MaxMessageSize {
+		return Record{}, fmt.Errorf("%w: %d bytes", ErrLength, n)
+	}
+
+	rec := Record{
+		Time:    int64(binary.LittleEndian.Uint64(hdr[0:])),
+		Message: make([]byte, n),
+	}
+	if _, err := io.ReadFull(r.r, rec.Message); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Record{}, err
+	}
+	return rec, nil
+}
+
+// ReadFile reads a whole capture.
+func ReadFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+
+	var records []Record
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		records = append(records, rec)
+	}
+}
+
+// LoadReplay reads the capture a sender replays, or returns nil if cfg has
+// none.
+func LoadReplay(cfg *conf.Config) ([]Record, error) {
+	if cfg.ReplayFile == "" {
+		return nil, nil
+	}
+
+	records, err := ReadFile(cfg.ReplayFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%v: empty capture", cfg.ReplayFile)
+	}
+	return records, nil
+}
@@ -0,0 +1,129 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+var testRecords = []Record{
+	{Time: 1_700_000_000_000_000_000, Message: []byte("first")},
+	{Time: 1_700_000_000_001_000_000, Message: nil},
+	{Time: 1_700_000_000_001_500_000, Message: bytes.Repeat([]byte{0xff}, 70_000)},
+}
+
+func write(t *testing.T, records []Record) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range records {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readAll(b []byte) ([]Record, error) {
+	r, err := NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	var records []Record
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	b := write(t, testRecords)
+
+	got, err := readAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(testRecords) {
+		t.Fatalf("read %v records, want %v", len(got), len(testRecords))
+	}
+	for i, r := range got {
+		if r.Time != testRecords[i].Time || !bytes.Equal(r.Message, testRecords[i].Message) {
+			t.Errorf("record %v: time %v, %v bytes, want %v, %v bytes",
+				i, r.Time, len(r.Message), testRecords[i].Time, len(testRecords[i].Message))
+		}
+	}
+
+	if got, err := readAll(write(t, nil)); err != nil || len(got) != 0 {
+		t.Errorf("empty capture: %v records, %v", len(got), err)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	b := write(t, testRecords[:1])
+	end := len(b)
+
+	tests := []struct {
+		name string
+		n    int
+		want error
+	}{
+		{name: "header", n: 3, want: io.ErrUnexpectedEOF},
+		{name: "record header", n: headerSize + 5, want: io.ErrUnexpectedEOF},
+		{name: "message", n: end - 1, want: io.ErrUnexpectedEOF},
+		{name: "no message", n: headerSize + recordHeaderSize, want: io.ErrUnexpectedEOF},
+		{name: "after a record", n: end, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readAll(b[:tt.n]); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBadHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(b []byte)
+		want    error
+	}{
+		{name: "magic", corrupt: func(b []byte) { b[0] = 'X' }, want: ErrMagic},
+		{name: "version", corrupt: func(b []byte) { b[4] = Version + 1 }, want: ErrVersion},
+		{
+			name: "length",
+			corrupt: func(b []byte) {
+				binary.LittleEndian.PutUint32(b[headerSize+8:], MaxMessageSize+1)
+			},
+			want: ErrLength,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := slices.Clone(write(t, testRecords[:1]))
+			tt.corrupt(b)
+			if _, err := readAll(b); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
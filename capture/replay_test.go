@@ -0,0 +1,66 @@
+package capture_test
+
+import (
+	"go-relay/capture"
+	"go-relay/cmd/conf"
+	"go-relay/pacer"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplayGaps(t *testing.T) {
+	ms := int64(time.Millisecond)
+	times := []int64{0, 10 * ms, 10 * ms, 40 * ms, 30 * ms}
+
+	path := filepath.Join(t.TempDir(), "test.cap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := capture.NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, at := range times {
+		if err := w.Write(capture.Record{Time: 1e18 + at, Message: []byte("m")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	tests := []struct {
+		speed float64
+		want  []int64 // gaps between due times, over two loops
+	}{
+		// The out-of-order record gets no gap, and the loop comes back
+		// after the mean gap.
+		{speed: 1, want: []int64{10 * ms, 0, 30 * ms, 0, 7_500_000, 10 * ms, 0, 30 * ms, 0}},
+		{speed: 2, want: []int64{5 * ms, 0, 15 * ms, 0, 3_750_000, 5 * ms, 0, 15 * ms, 0}},
+	}
+
+	for _, tt := range tests {
+		cfg := conf.Default()
+		cfg.ReplayFile = path
+		cfg.ReplaySpeed = tt.speed
+
+		records, err := capture.LoadReplay(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := pacer.New(cfg, records)
+
+		last := p.Next()
+		for i, want := range tt.want {
+			at := p.Next()
+			if got := at - last; got != want {
+				t.Errorf("speed %v: gap %v is %v, want %v", tt.speed, i, time.Duration(got), time.Duration(want))
+			}
+			last = at
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package chaos
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Directions faults can apply to. Up is from the client to the target,
+// down from the target to the client: relays and receivers dial, so
+// messages flow down.
+var Directions = []string{"both", "up", "down"}
+
+const (
+	dialTimeout = 5 * time.Second
+	chunkSize   = 32 << 10
+	chunkQueue  = 1024 // chunks held per direction before reads stop
+	rateSlice   = 1500 // bytes written at once under a rate cap
+)
+
+// Proxy forwards TCP connections to a target, applying the faults of the
+// current step of its schedule.
+type Proxy struct {
+	target   string
+	sched    *Schedule
+	up, down bool
+
+	mu      sync.Mutex
+	step    Step
+	changed chan struct{} // closed when the step changes
+	prng    *rand.Rand
+	links   map[*link]struct{}
+	nextID  int
+}
+
+type link struct {
+	id             int
+	client, server net.Conn
+
+	bytes atomic.Int64 // forwarded both ways
+	count atomic.Int64 // forwarded since the step started, for reset-every
+
+	once sync.Once
+	done chan struct{} // closed with the connections
+}
+
+type chunk struct {
+	b   []byte
+	due time.Time
+}
+
+func New(target string, sched *Schedule, direction string, seed int64) (*Proxy, error) {
+	p := &Proxy{
+		target:  target,
+		sched:   sched,
+		changed: make(chan struct{}),
+		prng:    rand.New(rand.NewSource(seed)),
+		links:   make(map[*link]struct{}),
+	}
+
+	switch direction {
+	case "both":
+		p.up, p.down = true, true
+	case "up":
+		p.up = true
+	case "down":
+		p.down = true
+	default:
+		return nil, fmt.Errorf("unknown direction %q", direction)
+	}
+	return p, nil
+}
+
+// Serve proxies the connections of ln until ctx is done, then closes them.
+func (p *Proxy) Serve(ctx context.Context, ln net.Listener) error {
+	go p.run(ctx)
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer p.closeAll()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.handle(conn)
+		}()
+	}
+}
+
+// run walks the schedule, logging every step so faults line up with the
+// reports of the other roles.
+func (p *Proxy) run(ctx context.Context) {
+	n := len(p.sched.Steps)
+	for {
+		for i, step := range p.sched.Steps {
+			p.enter(step)
+			if step.Duration == 0 {
+				log.Printf("chaos: step %d/%d until stopped: %v", i+1, n, step)
+			} else {
+				log.Printf("chaos: step %d/%d for %v: %v", i+1, n, step.Duration, step)
+			}
+			if step.Reset {
+				p.resetAll()
+			}
+			if step.Duration == 0 {
+				return
+			}
+
+			select {
+			case <-time.After(step.Duration):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if !p.sched.Loop || n == 0 {
+			break
+		}
+	}
+
+	p.enter(Step{})
+	log.Printf("chaos: schedule done: %v", Step{})
+}
+
+func (p *Proxy) enter(step Step) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.step = step
+	close(p.changed)
+	p.changed = make(chan struct{})
+	for l := range p.links {
+		l.count.Store(0)
+	}
+}
+
+func (p *Proxy) state() (Step, <-chan struct{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.step, p.changed
+}
+
+// delay returns the delay of a chunk read now.
+func (p *Proxy) delay() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.step.delay(p.prng.Float64())
+}
+
+func (p *Proxy) resetAll() {
+	p.mu.Lock()
+	links := make([]*link, 0, len(p.links))
+	for l := range p.links {
+		links = append(links, l)
+	}
+	p.mu.Unlock()
+
+	for _, l := range links {
+		log.Printf("chaos: conn %d: reset", l.id)
+		l.close(true)
+	}
+}
+
+func (p *Proxy) closeAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for l := range p.links {
+		l.close(false)
+	}
+}
+
+func (p *Proxy) handle(client net.Conn) {
+	server, err := net.DialTimeout("tcp", p.target, dialTimeout)
+	if err != nil {
+		log.Printf("chaos: dial %v: %v", p.target, err)
+		_ = client.Close()
+		return
+	}
+
+	p.mu.Lock()
+	p.nextID++
+	l := &link{id: p.nextID, client: client, server: server, done: make(chan struct{})}
+	p.links[l] = struct{}{}
+	p.mu.Unlock()
+	log.Printf("chaos: conn %d: %v to %v", l.id, client.RemoteAddr(), p.target)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.pipe(l, server, client, p.up)
+	}()
+	go func() {
+		defer wg.Done()
+		p.pipe(l, client, server, p.down)
+	}()
+	wg.Wait()
+	l.close(false)
+
+	p.mu.Lock()
+	delete(p.links, l)
+	p.mu.Unlock()
+	log.Printf("chaos: conn %d: closed after %d bytes", l.id, l.bytes.Load())
+}
+
+// pipe copies src to dst. With faults, chunks are held for their delay,
+// any stall and the rate cap; a stream cannot reorder, so a chunk is never
+// due before the one read ahead of it.
+func (p *Proxy) pipe(l *link, dst, src net.Conn, faulty bool) {
+	chunks := make(chan chunk, chunkQueue)
+	go func() {
+		defer close(chunks)
+
+		var last time.Time
+		for {
+			buf := make([]byte, chunkSize)
+			n, err := src.Read(buf)
+			if n > 0 {
+				c := chunk{b: buf[:n], due: time.Now()}
+				if faulty {
+					c.due = c.due.Add(p.delay())
+				}
+				if c.due.Before(last) {
+					c.due = last
+				}
+				last = c.due
+
+				select {
+				case chunks <- c:
+				case <-l.done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var next time.Time // when the rate cap lets the next bytes out
+	for c := range chunks {
+		if faulty && !p.hold(l, c.due) {
+			return
+		}
+
+		for b := c.b; len(b) > 0; {
+			var step Step
+			n := len(b)
+			if faulty {
+				step, _ = p.state()
+				if step.Rate > 0 {
+					n = min(n, rateSlice)
+				}
+				if step.ResetEvery > 0 {
+					n = int(min(int64(n), max(step.ResetEvery-l.count.Load(), 1)))
+				}
+			}
+
+			if _, err := dst.Write(b[:n]); err != nil {
+				l.close(false)
+				return
+			}
+			b = b[n:]
+			l.bytes.Add(int64(n))
+
+			if count := l.count.Add(int64(n)); step.ResetEvery > 0 && count >= step.ResetEvery {
+				log.Printf("chaos: conn %d: reset after %d bytes", l.id, l.bytes.Load())
+				l.close(true)
+				return
+			}
+			if step.Rate > 0 {
+				if now := time.Now(); next.Before(now) {
+					next = now
+				}
+				next = next.Add(time.Duration(n) * time.Second / time.Duration(step.Rate))
+				if !l.sleepUntil(next) {
+					return
+				}
+			}
+		}
+	}
+
+	// Pass the end of the stream on.
+	if tcp, ok := dst.(*net.TCPConn); ok {
+		_ = tcp.CloseWrite()
+	}
+}
+
+// hold waits for a chunk to be due and for any stall to end, and reports
+// whether the link is still open.
+func (p *Proxy) hold(l *link, due time.Time) bool {
+	if !l.sleepUntil(due) {
+		return false
+	}
+	for {
+		step, changed := p.state()
+		if !step.Stall {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-l.done:
+			return false
+		}
+	}
+}
+
+func (l *link) sleepUntil(t time.Time) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-l.done:
+		return false
+	}
+}
+
+// close closes both connections, with a reset instead of an orderly
+// shutdown when reset is set.
+func (l *link) close(reset bool) {
+	l.once.Do(func() {
+		for _, c := range []net.Conn{l.client, l.server} {
+			if tcp, ok := c.(*net.TCPConn); ok && reset {
+				_ = tcp.SetLinger(0)
+			}
+			_ = c.Close()
+		}
+		close(l.done)
+	})
+}
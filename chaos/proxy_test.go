@@ -0,0 +1,206 @@
+package chaos
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startProxy proxies to a target serving each connection with serve, and
+// returns the address of the proxy.
+func startProxy(t *testing.T, sched *Schedule, direction string, serve func(net.Conn)) string {
+	t.Helper()
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+
+	p, err := New(target.Addr().String(), sched, direction, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = p.Serve(ctx, ln)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return ln.Addr().String()
+}
+
+func parse(t *testing.T, text string) *Schedule {
+	t.Helper()
+
+	sched, err := Parse(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sched
+}
+
+func echo(conn net.Conn) { _, _ = io.Copy(conn, conn) }
+
+func TestProxyDelay(t *testing.T) {
+	const delay = 100 * time.Millisecond
+
+	tests := []struct {
+		direction string
+		want      time.Duration // for a round trip
+	}{
+		{"both", 2 * delay},
+		{"up", delay},
+		{"down", delay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.direction, func(t *testing.T) {
+			addr := startProxy(t, parse(t, "0 delay=100ms"), tt.direction, echo)
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			start := time.Now()
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(conn, buf); err != nil {
+				t.Fatal(err)
+			}
+
+			if rtt := time.Since(start); rtt < tt.want || rtt > tt.want+delay {
+				t.Errorf("round trip took %v, want about %v", rtt, tt.want)
+			}
+			if string(buf) != "ping" {
+				t.Errorf("echoed %q", buf)
+			}
+		})
+	}
+}
+
+func TestProxyResetEvery(t *testing.T) {
+	const limit = 1000
+
+	// Asked by the client, the target sends far more than the limit.
+	addr := startProxy(t, parse(t, "0 reset-every=1k"), "down", func(conn net.Conn) {
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			return
+		}
+		_, _ = conn.Write(bytes.Repeat([]byte{'x'}, 10*limit))
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("?")); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := io.Copy(io.Discard, conn)
+	if n > limit {
+		t.Errorf("read %v bytes through a link reset after %v", n, limit)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("link not reset")
+	}
+}
+
+func TestProxyStall(t *testing.T) {
+	const stall = 200 * time.Millisecond
+
+	start := time.Now()
+	addr := startProxy(t, parse(t, "200ms stall; 0"), "down", func(conn net.Conn) {
+		_, _ = conn.Write([]byte("hello"))
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < stall {
+		t.Errorf("data arrived after %v, during the %v stall", waited, stall)
+	}
+	if string(buf) != "hello" {
+		t.Errorf("read %q", buf)
+	}
+}
+
+func TestProxyLoop(t *testing.T) {
+	sched := &Schedule{
+		Steps: []Step{{Duration: 50 * time.Millisecond, Stall: true}, {Duration: 50 * time.Millisecond}},
+		Loop:  true,
+	}
+	p, err := New("", sched, "both", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, changed := p.state()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.run(ctx)
+	}()
+
+	// The steps come around again instead of ending clean.
+	var stalls []bool
+	for len(stalls) < 5 {
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no step change after %v", stalls)
+		}
+		var step Step
+		step, changed = p.state()
+		stalls = append(stalls, step.Stall)
+	}
+	cancel()
+	<-done
+
+	for i, stall := range stalls {
+		if want := i%2 == 0; stall != want {
+			t.Fatalf("steps stalled %v, want alternating from true", stalls)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+// Package chaos injects faults into TCP connections from userspace: delay,
+// jitter, bandwidth caps, stalls and resets, following a schedule of steps.
+package chaos
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Step is a set of faults held for a while. The zero Step forwards
+// traffic untouched.
+type Step struct {
+	Duration   time.Duration // 0 holds the step for the rest of the run
+	Delay      time.Duration
+	Jitter     time.Duration // delay varies uniformly by ±Jitter
+	Rate       int64         // bytes per second each way, 0 uncapped
+	Stall      bool          // hold every byte until the step ends
+	Reset      bool          // reset every connection as the step starts
+	ResetEvery int64         // reset connections after this many bytes, 0 never
+
+	text string
+}
+
+func (s Step) String() string {
+	if s.text == "" {
+		return "clean"
+	}
+	return s.text
+}
+
+// Schedule is the steps a proxy goes through, in order.
+type Schedule struct {
+	Steps []Step
+	Loop  bool // start over after the last step instead of running clean
+}
+
+// Parse reads a schedule of steps separated by semicolons or newlines. A
+// step is a duration followed by its faults, e.g.
+//
+//	30s delay=5ms jitter=2ms; 10s stall; 1m reset-every=10k; 30s rate=1m
+//
+// Byte counts take k, m and g suffixes in powers of 1000. A duration of 0
+// holds the last step for the rest of the run. Text after # is ignored.
+func Parse(text string) (*Schedule, error) {
+	var sched Schedule
+
+	for _, line := range strings.Split(text, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		for _, field := range strings.Split(line, ";") {
+			if strings.TrimSpace(field) == "" {
+				continue
+			}
+			step, err := parseStep(field)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: %w", len(sched.Steps)+1, err)
+			}
+			sched.Steps = append(sched.Steps, step)
+		}
+	}
+
+	for i, step := range sched.Steps {
+		if step.Duration == 0 && i != len(sched.Steps)-1 {
+			return nil, fmt.Errorf("step %d: only the last step can run for the rest of the run", i+1)
+		}
+	}
+	return &sched, nil
+}
+
+func parseStep(text string) (Step, error) {
+	fields := strings.Fields(text)
+
+	d, err := time.ParseDuration(fields[0])
+	if err != nil {
+		return Step{}, err
+	}
+	if d < 0 {
+		return Step{}, errors.New("negative duration")
+	}
+	step := Step{Duration: d, text: strings.Join(fields[1:], " ")}
+
+	for _, f := range fields[1:] {
+		key, value, _ := strings.Cut(f, "=")
+		switch key {
+		case "delay":
+			step.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			step.Jitter, err = time.ParseDuration(value)
+		case "rate":
+			step.Rate, err = parseBytes(value)
+		case "stall":
+			step.Stall = true
+		case "reset":
+			step.Reset = true
+		case "reset-every":
+			step.ResetEvery, err = parseBytes(value)
+		default:
+			err = fmt.Errorf("unknown fault %q", key)
+		}
+		if err != nil {
+			return Step{}, err
+		}
+	}
+
+	switch {
+	case step.Delay < 0 || step.Jitter < 0:
+		return Step{}, errors.New("delay and jitter must not be negative")
+	case step.Jitter > step.Delay:
+		return Step{}, errors.New("jitter must not exceed delay")
+	case step.Stall && step.Duration == 0:
+		return Step{}, errors.New("stall must end")
+	}
+	return step, nil
+}
+
+func parseBytes(s string) (int64, error) {
+	scale := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"):
+		scale = 1e3
+	case strings.HasSuffix(s, "m"):
+		scale = 1e6
+	case strings.HasSuffix(s, "g"):
+		scale = 1e9
+	}
+	if scale > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, errors.New("byte counts must be positive")
+	}
+	return n * scale, nil
+}
+
+// delay returns the delay of a chunk for f uniform in [0, 1).
+func (s Step) delay(f float64) time.Duration {
+	return s.Delay + time.Duration((2*f-1)*float64(s.Jitter))
+}
@@ -0,0 +1,105 @@
+package chaos
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []Step
+		wantErr string
+	}{
+		{
+			name: "empty",
+			text: " \n# nothing\n;",
+		},
+		{
+			name: "durations",
+			text: "1.5s delay=5ms jitter=500us; 2m delay=1h",
+			want: []Step{
+				{Duration: 1500 * time.Millisecond, Delay: 5 * time.Millisecond, Jitter: 500 * time.Microsecond, text: "delay=5ms jitter=500us"},
+				{Duration: 2 * time.Minute, Delay: time.Hour, text: "delay=1h"},
+			},
+		},
+		{
+			name: "byte suffixes",
+			text: "1s rate=512; 1s rate=10k; 1s reset-every=2m; 1s rate=1g",
+			want: []Step{
+				{Duration: time.Second, Rate: 512, text: "rate=512"},
+				{Duration: time.Second, Rate: 10_000, text: "rate=10k"},
+				{Duration: time.Second, ResetEvery: 2_000_000, text: "reset-every=2m"},
+				{Duration: time.Second, Rate: 1_000_000_000, text: "rate=1g"},
+			},
+		},
+		{
+			name: "lines and comments",
+			text: "10s stall # wait\n\n5s reset\n0",
+			want: []Step{
+				{Duration: 10 * time.Second, Stall: true, text: "stall"},
+				{Duration: 5 * time.Second, Reset: true, text: "reset"},
+				{},
+			},
+		},
+		{
+			name: "zero duration last",
+			text: "1s; 0 delay=1ms",
+			want: []Step{
+				{Duration: time.Second},
+				{Delay: time.Millisecond, text: "delay=1ms"},
+			},
+		},
+		{name: "zero duration before the last", text: "0 delay=1ms; 1s", wantErr: "step 1: only the last step"},
+		{name: "jitter over delay", text: "1s delay=1ms jitter=2ms", wantErr: "jitter must not exceed delay"},
+		{name: "jitter without delay", text: "1s jitter=1ms", wantErr: "jitter must not exceed delay"},
+		{name: "negative delay", text: "1s delay=-1ms", wantErr: "must not be negative"},
+		{name: "stall without end", text: "1s; 0 stall", wantErr: "step 2: stall must end"},
+		{name: "negative duration", text: "-1s", wantErr: "negative duration"},
+		{name: "bad duration", text: "soon delay=1ms", wantErr: "step 1:"},
+		{name: "unknown fault", text: "1s drop=1", wantErr: `unknown fault "drop"`},
+		{name: "zero bytes", text: "1s rate=0k", wantErr: "must be positive"},
+		{name: "bad suffix", text: "1s rate=1t", wantErr: "step 1:"},
+		{name: "missing bytes", text: "1s reset-every", wantErr: "step 1:"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sched, err := Parse(tt.text)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(sched.Steps, tt.want) {
+				t.Errorf("got %+v, want %+v", sched.Steps, tt.want)
+			}
+			if sched.Loop {
+				t.Error("Parse set Loop")
+			}
+		})
+	}
+}
+
+func TestStepDelay(t *testing.T) {
+	s := Step{Delay: 10 * time.Millisecond, Jitter: 4 * time.Millisecond}
+	for _, tt := range []struct {
+		f    float64
+		want time.Duration
+	}{
+		{0, 6 * time.Millisecond},
+		{0.5, 10 * time.Millisecond},
+		{0.75, 12 * time.Millisecond},
+	} {
+		if got := s.delay(tt.f); got != tt.want {
+			t.Errorf("delay(%v) = %v, want %v", tt.f, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Package clock lets receivers measure one-way latency against a sender on
+// another host. Senders serve their clock over UDP and receivers estimate
+// the offset between the two clocks, and its drift, NTP-style from the
+// round trips of timestamped probes.
+//
+// A probe is 12 bytes and its reply 28, little-endian:
+//
+//	offset  size  field
+//	0       4     magic "GRCK"
+//	4       8     t1, probe sent by the receiver
+//	12      8     t2, probe received by the sender (reply only)
+//	20      8     t3, reply sent by the sender (reply only)
+package clock
+
+import (
+	"encoding/binary"
+	"go-relay/cmd/conf"
+	"net"
+	"time"
+)
+
+const (
+	Magic uint32 = 0x4b435247 // "GRCK" on the wire
+
+	probeSize = 12
+	replySize = 28
+)
+
+// Clock reads the time, optionally skewed to test offset estimation on a
+// single host. The zero Clock reads the system clock as is.
+type Clock struct {
+	skew  int64   // ns
+	drift float64 // fraction
+	start int64
+}
+
+// FromConfig returns the clock of cfg, skewed by its clock skew and drift.
+func FromConfig(cfg *conf.Config) *Clock {
+	return &Clock{
+		skew:  int64(cfg.ClockSkew),
+		drift: cfg.ClockDriftPPM / 1e6,
+		start: time.Now().UnixNano(),
+	}
+}
+
+// Now returns the time in unix nanoseconds.
+func (c *Clock) Now() int64 {
+	return c.At(time.Now().UnixNano())
+}
+
+// At converts a time read from the system clock.
+func (c *Clock) At(unixNano int64) int64 {
+	return unixNano + c.skew + int64(c.drift*float64(unixNano-c.start))
+}
+
+// Serve answers the probes of receivers on the UDP address addr. It only
+// returns on errors.
+func Serve(addr string, c *Clock) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, replySize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		t2 := c.Now()
+		if n != probeSize || binary.LittleEndian.Uint32(buf) != Magic {
+			continue
+		}
+
+		binary.LittleEndian.PutUint64(buf[12:], uint64(t2))
+		binary.LittleEndian.PutUint64(buf[20:], uint64(c.Now()))
+		_, _ = conn.WriteTo(buf[:replySize], from)
+	}
+}
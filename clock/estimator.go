@@ -0,0 +1,227 @@
+package clock
+
+import (
+	"cmp"
+	"context"
+	"encoding/binary"
+	"errors"
+	"go-relay/cmd/conf"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// syncProbes are sent when an Estimator starts, so the first estimate
+	// does not rest on a single round trip.
+	syncProbes = 8
+
+	// minDriftSpan is the shortest time samples must span to estimate the
+	// drift; over shorter ones jitter swamps it.
+	minDriftSpan = 5 * time.Second
+
+	// filterSize samples in a row are reduced to the one with the shortest
+	// round trip, the least delayed by queueing.
+	filterSize = 4
+)
+
+var ErrNoReply = errors.New("clock: no reply from sender")
+
+// Estimate is the offset of a remote clock from the local one.
+type Estimate struct {
+	At          int64   // local unix ns the offset was estimated for
+	Offset      int64   // remote minus local clock at At, ns
+	Drift       float64 // change of the offset per local ns
+	Uncertainty int64   // bound of the error of Offset, ns
+	Samples     int
+}
+
+// OffsetAt extrapolates the offset to the local time t.
+func (e Estimate) OffsetAt(t int64) int64 {
+	return e.Offset + int64(e.Drift*float64(t-e.At))
+}
+
+type sample struct {
+	at     int64 // local midpoint of the round trip
+	offset int64
+	delay  int64 // round trip without the sender's processing
+}
+
+// Estimator probes a sender's clock at an interval and keeps the latest
+// samples. Round trips are symmetric at best, so each sample bounds the
+// offset to within half its delay: the offset and drift are fitted to the
+// samples with the shortest round trips.
+type Estimator struct {
+	conn     net.Conn
+	interval time.Duration
+	window   int
+
+	mu       sync.Mutex
+	samples  []sample // ring of the latest window samples
+	next     int
+	estimate Estimate
+}
+
+// Dial starts estimating the offset of the clock served at the UDP address
+// addr, waiting for the first round trips.
+func Dial(addr string, cfg *conf.Config) (*Estimator, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Estimator{
+		conn:     conn,
+		interval: cfg.ClockInterval,
+		window:   cfg.ClockWindow,
+		samples:  make([]sample, 0, cfg.ClockWindow),
+	}
+
+	for range syncProbes {
+		if s, err := e.probe(); err == nil {
+			e.add(s)
+		}
+	}
+	if len(e.samples) == 0 {
+		conn.Close()
+		return nil, ErrNoReply
+	}
+	return e, nil
+}
+
+// Run probes until ctx is done, then closes the estimator.
+func (e *Estimator) Run(ctx context.Context) {
+	defer e.conn.Close()
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if s, err := e.probe(); err == nil {
+				e.add(s)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Estimate returns the latest estimate.
+func (e *Estimator) Estimate() Estimate {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.estimate
+}
+
+func (e *Estimator) probe() (sample, error) {
+	buf := make([]byte, replySize)
+	binary.LittleEndian.PutUint32(buf, Magic)
+
+	t1 := time.Now().UnixNano()
+	binary.LittleEndian.PutUint64(buf[4:], uint64(t1))
+	if _, err := e.conn.Write(buf[:probeSize]); err != nil {
+		return sample{}, err
+	}
+
+	_ = e.conn.SetReadDeadline(time.Now().Add(e.interval))
+	for {
+		n, err := e.conn.Read(buf)
+		if err != nil {
+			return sample{}, err
+		}
+		t4 := time.Now().UnixNano()
+
+		// Replies to earlier, timed out probes are skipped.
+		if n != replySize || binary.LittleEndian.Uint32(buf) != Magic || int64(binary.LittleEndian.Uint64(buf[4:])) != t1 {
+			continue
+		}
+
+		t2 := int64(binary.LittleEndian.Uint64(buf[12:]))
+		t3 := int64(binary.LittleEndian.Uint64(buf[20:]))
+		return newSample(t1, t2, t3, t4), nil
+	}
+}
+
+// newSample is the sample of a probe sent at t1 and answered at t4 on the
+// local clock, received at t2 and answered at t3 on the remote one.
+func newSample(t1, t2, t3, t4 int64) sample {
+	return sample{
+		at:     t1 + (t4-t1)/2,
+		offset: ((t2 - t1) + (t3 - t4)) / 2,
+		delay:  (t4 - t1) - (t3 - t2),
+	}
+}
+
+func (e *Estimator) add(s sample) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.samples) < e.window {
+		e.samples = append(e.samples, s)
+	} else {
+		e.samples[e.next] = s
+		e.next = (e.next + 1) % e.window
+	}
+	e.estimate = fit(e.samples, s.at)
+}
+
+// fit estimates the offset at the local time at by a least-squares line
+// through the sample with the shortest round trip of every filterSize in a
+// row, which spreads the points over the window.
+func fit(samples []sample, at int64) Estimate {
+	sorted := slices.SortedFunc(slices.Values(samples), func(a, b sample) int {
+		return cmp.Compare(a.at, b.at)
+	})
+
+	var best []sample
+	for end := len(sorted); end > 0; end -= filterSize {
+		group := sorted[max(end-filterSize, 0):end]
+		best = append(best, slices.MinFunc(group, func(a, b sample) int {
+			return cmp.Compare(a.delay, b.delay)
+		}))
+	}
+
+	var mx, my float64
+	for _, s := range best {
+		mx += float64(s.at - at)
+		my += float64(s.offset)
+	}
+	mx /= float64(len(best))
+	my /= float64(len(best))
+
+	var sxx, sxy float64
+	for _, s := range best {
+		dx := float64(s.at-at) - mx
+		sxx += dx * dx
+		sxy += dx * (float64(s.offset) - my)
+	}
+
+	var drift float64
+	if sorted[len(sorted)-1].at-sorted[0].at >= int64(minDriftSpan) && sxx > 0 {
+		drift = sxy / sxx
+	}
+	offset := my - drift*mx
+
+	// Half its round trip bounds the error of a sample; the scatter around
+	// the line adds to it.
+	var halfDelay, sse float64
+	for _, s := range best {
+		halfDelay += float64(s.delay) / 2
+		r := float64(s.offset) - (offset + drift*float64(s.at-at))
+		sse += r * r
+	}
+	n := float64(len(best))
+
+	return Estimate{
+		At:          at,
+		Offset:      int64(offset),
+		Drift:       drift,
+		Uncertainty: int64(max(halfDelay/n, 0) + math.Sqrt(sse/n)),
+		Samples:     len(best),
+	}
+}
@@ -0,0 +1,82 @@
+package clock
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// TestEstimatorSkew feeds an Estimator the probes of a sender whose clock
+// is skewed and drifts, over a path with jittery, asymmetric delays.
+func TestEstimatorSkew(t *testing.T) {
+	tests := []struct {
+		name     string
+		skew     time.Duration
+		driftPPM float64
+		probes   int
+		interval time.Duration
+	}{
+		{name: "in sync", probes: 64, interval: time.Second},
+		{name: "ahead", skew: 250 * time.Millisecond, probes: 64, interval: time.Second},
+		{name: "behind and fast", skew: -3 * time.Second, driftPPM: 50, probes: 64, interval: time.Second},
+		{name: "ahead and slow", skew: time.Second, driftPPM: -100, probes: 64, interval: time.Second},
+		{name: "window wrapped", skew: 40 * time.Millisecond, driftPPM: 20, probes: 200, interval: 500 * time.Millisecond},
+		{name: "too short for drift", skew: 5 * time.Millisecond, probes: 8, interval: 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rng := rand.New(rand.NewSource(1))
+
+			start := time.Now().UnixNano()
+			remote := &Clock{skew: int64(tt.skew), drift: tt.driftPPM / 1e6, start: start}
+
+			const window = 64
+			e := &Estimator{window: window, samples: make([]sample, 0, window)}
+
+			jitter := func() int64 {
+				return int64(50*time.Microsecond) + rng.Int63n(int64(2*time.Millisecond))
+			}
+			for i := range tt.probes {
+				t1 := start + int64(i)*int64(tt.interval)
+				received := t1 + jitter()
+				answered := received + int64(10*time.Microsecond)
+				t4 := answered + jitter()
+
+				e.add(newSample(t1, remote.At(received), remote.At(answered), t4))
+			}
+
+			est := e.Estimate()
+			if est.Uncertainty <= 0 {
+				t.Fatalf("uncertainty %v", est.Uncertainty)
+			}
+
+			want := remote.At(est.At) - est.At
+			if d := abs(est.Offset - want); d > est.Uncertainty {
+				t.Errorf("offset %v, want %v ± %v", time.Duration(est.Offset), time.Duration(want), time.Duration(est.Uncertainty))
+			}
+
+			// A wrong drift moves the offset by up to half the window
+			// away from its middle.
+			span := float64(min(tt.probes, window)-1) * float64(tt.interval)
+			if time.Duration(span) < minDriftSpan {
+				if est.Drift != 0 {
+					t.Errorf("drift %v ppm over %v", est.Drift*1e6, time.Duration(span))
+				}
+				return
+			}
+			if d := math.Abs(est.Drift-tt.driftPPM/1e6) * span / 2; d > float64(est.Uncertainty) {
+				t.Errorf("drift %.3f ppm, want %.3f ppm: %v off at the window's ends, uncertainty %v",
+					est.Drift*1e6, tt.driftPPM, time.Duration(d), time.Duration(est.Uncertainty))
+			}
+		})
+	}
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
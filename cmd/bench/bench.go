@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"go-relay/cmd/conf"
+	"go-relay/stats"
+	"go-relay/tlsconf"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultDuration = 10 * time.Second
+	stopTimeout     = 5 * time.Second
+)
+
+type pipeline struct {
+	sender   string
+	relay    string
+	receiver string
+}
+
+func (p pipeline) String() string {
+	return p.sender + "/" + p.relay + "/" + p.receiver
+}
+
+var stacks = map[string]pipeline{
+	"gorilla": {"sender", "relay", "receiver"},
+	"gws":     {"gwssender", "gwsrelay", "gwsreceiver"},
+	"gev":     {"kernelsender", "kernelrelay", "kernelreceiver"},
+	"kcp":     {"kcpsender", "kcprelay", "kcpreceiver"},
+	"mixed":   {"gwssender", "kernelrelay", "receiver"},
+}
+
+// Every role, in the order matrix runs use.
+var (
+	senders   = []string{"sender", "gwssender", "kernelsender", "kcpsender"}
+	relays    = []string{"relay", "gwsrelay", "kernelrelay", "kcprelay"}
+	receivers = []string{"receiver", "gwsreceiver", "kernelreceiver", "kcpreceiver"}
+)
+
+// transport tells which roles can be wired together: the websocket roles
+// interoperate, the KCP roles only talk to each other.
+func transport(role string) string {
+	if strings.HasPrefix(role, "kcp") {
+		return "kcp"
+	}
+	return "websocket"
+}
+
+// udpRoles listen on UDP, where readiness cannot be probed with a dial.
+var udpRoles = map[string]bool{
+	"kcpsender": true,
+	"kcprelay":  true,
+}
+
+func main() {
+	var (
+		p            pipeline
+		binDir       string
+		readyTimeout time.Duration
+		matrix       bool
+	)
+
+	flag.StringVar(&p.sender, "sender", "", "sender command, overrides the stack's")
+	flag.StringVar(&p.relay, "relay", "", "relay command, overrides the stack's")
+	flag.StringVar(&p.receiver, "receiver", "", "receiver command, overrides the stack's")
+	flag.StringVar(&binDir, "bin-dir", "", "directory of the role binaries, defaults to the directory of bench")
+	flag.DurationVar(&readyTimeout, "ready-timeout", 10*time.Second, "how long to wait for a role to listen")
+	flag.BoolVar(&matrix, "matrix", false, "run every compatible sender, relay and receiver combination; -sender, -relay and -receiver take comma-separated lists to narrow it")
+
+	ownFlags := map[string]bool{}
+	flag.VisitAll(func(f *flag.Flag) { ownFlags[f.Name] = true })
+
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.MetricsAddr != "" {
+		_, port, err := net.SplitHostPort(cfg.MetricsAddr)
+		if _, perr := strconv.Atoi(port); err != nil || perr != nil {
+			log.Fatalf("metrics-addr %q needs a numeric port", cfg.MetricsAddr)
+		}
+	}
+
+	if binDir == "" {
+		exe, err := os.Executable()
+		if err != nil {
+			log.Fatal(err)
+		}
+		binDir = filepath.Dir(exe)
+	}
+
+	// Every role gets the benchmark settings given to bench. The stack is
+	// set per run, and the results file is bench's to write.
+	var args []string
+	flag.Visit(func(f *flag.Flag) {
+		if !ownFlags[f.Name] && f.Name != "stack" && f.Name != "results-file" && f.Name != "results-format" {
+			args = append(args, "-"+f.Name+"="+f.Value.String())
+		}
+	})
+	if cfg.Duration == 0 && cfg.MessageCount == 0 {
+		args = append(args, "-duration="+defaultDuration.String())
+	}
+
+	// TLS runs without certificates share a CA and certificate generated
+	// for the run.
+	if cfg.TLS && cfg.TLSCert == "" && cfg.TLSCA == "" {
+		dir, err := os.MkdirTemp("", "go-relay-tls")
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		files, err := tlsconf.Generate(dir, tlsconf.Hosts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		args = append(args, "-tls-cert="+files.Cert, "-tls-key="+files.Key, "-tls-ca="+files.CA)
+	}
+
+	// Receivers write their results to a file per run, which bench reads
+	// back and appends to -results-file.
+	resultsDir, err := os.MkdirTemp("", "go-relay-results")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(resultsDir)
+
+	var sink stats.Sink
+	if cfg.ResultsFile != "" {
+		sink, err = stats.OpenSink(cfg.ResultsFile, cfg.ResultsFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sink.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	r := &runner{cfg: cfg, binDir: binDir, args: args, readyTimeout: readyTimeout, resultsDir: resultsDir, sink: sink}
+
+	if matrix {
+		results := r.runMatrix(ctx, combinations(p))
+		fmt.Println()
+		printTable(os.Stdout, results)
+		return
+	}
+
+	stack := cfg.Stack
+	if stack == "" {
+		stack = "gorilla"
+	}
+	base, ok := stacks[stack]
+	if !ok {
+		log.Fatalf("unknown stack %q, want gorilla, gws, gev, kcp or mixed", stack)
+	}
+	if p != (pipeline{}) {
+		stack = p.withDefaults(base).String()
+	}
+	p = p.withDefaults(base)
+
+	final, err := r.run(ctx, p, stack)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("\nResult: stack=%v\n", stack)
+	printTable(os.Stdout, []result{{pipeline: p, final: final}})
+}
+
+func (p pipeline) withDefaults(base pipeline) pipeline {
+	if p.sender == "" {
+		p.sender = base.sender
+	}
+	if p.relay == "" {
+		p.relay = base.relay
+	}
+	if p.receiver == "" {
+		p.receiver = base.receiver
+	}
+	return p
+}
+
+// combinations expands the comma-separated role lists of p, all roles when
+// empty, into every pipeline whose roles share a transport.
+func combinations(p pipeline) []pipeline {
+	list := func(s string, all []string) []string {
+		if s == "" {
+			return all
+		}
+		return strings.Split(s, ",")
+	}
+
+	var ps []pipeline
+	for _, sender := range list(p.sender, senders) {
+		for _, relay := range list(p.relay, relays) {
+			for _, receiver := range list(p.receiver, receivers) {
+				if transport(sender) != transport(relay) || transport(relay) != transport(receiver) {
+					continue
+				}
+				ps = append(ps, pipeline{sender, relay, receiver})
+			}
+		}
+	}
+	return ps
+}
+
+type runner struct {
+	cfg          *conf.Config
+	binDir       string
+	args         []string
+	readyTimeout time.Duration
+	resultsDir   string     // for the results file of each run
+	sink         stats.Sink // nil without -results-file
+}
+
+// run starts the sender and relay, waits for each to listen, then runs the
+// receiver to completion and returns its final result. stack names the run
+// in results.
+func (r *runner) run(ctx context.Context, p pipeline, stack string) (stats.Result, error) {
+	var final stats.Result
+
+	sender, err := r.start(p.sender, r.argsFor(stack, 0))
+	if err != nil {
+		return final, err
+	}
+	defer sender.stop()
+
+	if err := r.waitReady(ctx, sender, r.cfg.SenderAddrs()[0]); err != nil {
+		return final, err
+	}
+
+	relay, err := r.start(p.relay, r.argsFor(stack, 1))
+	if err != nil {
+		return final, err
+	}
+	defer relay.stop()
+
+	if err := r.waitReady(ctx, relay, r.cfg.RelayAddr); err != nil {
+		return final, err
+	}
+
+	f, err := os.CreateTemp(r.resultsDir, "*.jsonl")
+	if err != nil {
+		return final, err
+	}
+	f.Close()
+
+	args := append(r.argsFor(stack, 2), "-results-file="+f.Name(), "-results-format=jsonl")
+	receiver, err := r.start(p.receiver, args)
+	if err != nil {
+		return final, err
+	}
+
+	select {
+	case <-receiver.done:
+	case <-ctx.Done():
+		receiver.stop()
+	}
+	receiver.wait()
+
+	results, err := readResults(f.Name())
+	if err != nil {
+		return final, err
+	}
+	if r.sink != nil {
+		for _, res := range results {
+			if err := r.sink.Write(res); err != nil {
+				return final, err
+			}
+		}
+	}
+
+	final, ok := finalResult(results)
+	if !ok {
+		return final, fmt.Errorf("%v exited without a final result: %v", p.receiver, receiver.err)
+	}
+	return final, nil
+}
+
+// argsFor returns the arguments of the sender (0), relay (1) or receiver (2).
+// Each role serves metrics on its own port, counting up from -metrics-addr.
+func (r *runner) argsFor(stack string, role int) []string {
+	args := append(slices.Clip(r.args), "-stack="+stack)
+	if r.cfg.MetricsAddr != "" {
+		host, port, _ := net.SplitHostPort(r.cfg.MetricsAddr)
+		n, _ := strconv.Atoi(port)
+		args = append(args, "-metrics-addr="+net.JoinHostPort(host, strconv.Itoa(n+role)))
+	}
+	return args
+}
+
+// runMatrix runs the pipelines one after another. A failing pipeline is
+// recorded and does not stop the others.
+func (r *runner) runMatrix(ctx context.Context, ps []pipeline) []result {
+	var results []result
+	for i, p := range ps {
+		if ctx.Err() != nil {
+			break
+		}
+		fmt.Printf("\n=== %d/%d: %v\n", i+1, len(ps), p)
+
+		final, err := r.run(ctx, p, p.String())
+		results = append(results, result{pipeline: p, final: final, err: err})
+	}
+	return results
+}
+
+type process struct {
+	name string
+	cmd  *exec.Cmd
+	done chan struct{}
+	err  error
+
+	output sync.WaitGroup
+}
+
+// start launches a role binary, prefixing its output with the role name.
+func (r *runner) start(name string, args []string) (*process, error) {
+	path := filepath.Join(r.binDir, name)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("%w (build the roles with `make build` or pass -bin-dir)", err)
+	}
+
+	pr, pw := io.Pipe()
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	proc := &process{name: name, cmd: cmd, done: make(chan struct{})}
+
+	proc.output.Add(1)
+	go func() {
+		defer proc.output.Done()
+
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			fmt.Printf("[%v] %v\n", name, scanner.Text())
+		}
+	}()
+
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return nil, err
+	}
+
+	go func() {
+		proc.err = cmd.Wait()
+		pw.Close()
+		close(proc.done)
+	}()
+
+	return proc, nil
+}
+
+// stop interrupts the process and kills it if it does not exit in time.
+func (p *process) stop() {
+	select {
+	case <-p.done:
+		return
+	default:
+	}
+
+	_ = p.cmd.Process.Signal(os.Interrupt)
+
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+		_ = p.cmd.Process.Kill()
+		<-p.done
+	}
+	p.output.Wait()
+}
+
+// wait blocks until the process has exited and its output is drained.
+func (p *process) wait() {
+	<-p.done
+	p.output.Wait()
+}
+
+// waitReady blocks until a TCP role accepts connections. UDP roles cannot
+// be probed, so they get a fixed grace period.
+func (r *runner) waitReady(ctx context.Context, p *process, addr string) error {
+	if udpRoles[p.name] {
+		select {
+		case <-time.After(500 * time.Millisecond):
+			return nil
+		case <-p.done:
+			return fmt.Errorf("%v exited: %v", p.name, p.err)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	deadline := time.Now().Add(r.readyTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v not listening on %v: %w", p.name, addr, err)
+		}
+
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-p.done:
+			return fmt.Errorf("%v exited: %v", p.name, p.err)
+		case <-ctx.Done():
+			return errors.Join(ctx.Err(), err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"go-relay/stats"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+type result struct {
+	pipeline pipeline
+	final    stats.Result
+	err      error
+}
+
+// readResults reads the records a receiver wrote to a JSON Lines results
+// file.
+func readResults(path string) ([]stats.Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var results []stats.Result
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var r stats.Result
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%v: %w", path, err)
+		}
+		results = append(results, r)
+	}
+	return results, scanner.Err()
+}
+
+// finalResult returns the last final record of results.
+func finalResult(results []stats.Result) (stats.Result, bool) {
+	for i := len(results) - 1; i >= 0; i-- {
+		if results[i].Kind == "final" {
+			return results[i], true
+		}
+	}
+	return stats.Result{}, false
+}
+
+// printTable writes one row per pipeline.
+func printTable(w io.Writer, results []result) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "Sender\tRelay\tReceiver\tCount\tP50\tP99\tMax\tLost\tMsg/s\tMB/s\t")
+
+	for _, res := range results {
+		p := res.pipeline
+		if res.err != nil {
+			fmt.Fprintf(tw, "%v\t%v\t%v\terror: %v\t\n", p.sender, p.relay, p.receiver, res.err)
+			continue
+		}
+
+		r := res.final
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%d\t%v\t%v\t%v\t%d\t%.0f\t%.3f\t\n",
+			p.sender, p.relay, p.receiver,
+			r.Count,
+			time.Duration(r.P50Ns), time.Duration(r.P99Ns), time.Duration(r.MaxNs),
+			r.Lost,
+			r.MsgPerSec, r.MBPerSec,
+		)
+	}
+
+	tw.Flush()
+}
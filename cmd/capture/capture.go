@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"github.com/gorilla/websocket"
+	"go-relay/capture"
+	"go-relay/cmd/conf"
+	"go-relay/kcpconn"
+	"go-relay/relay"
+	"go-relay/tlsconf"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// source is a relay connection messages are captured from.
+type source interface {
+	ReadMessage() ([]byte, error)
+	Close() error
+}
+
+type wsSource struct {
+	*websocket.Conn
+	timeout time.Duration
+}
+
+func (s wsSource) ReadMessage() ([]byte, error) {
+	_, msg, err := s.Conn.ReadMessage()
+	return msg, err
+}
+
+// Close asks the relay to close the connection before closing it.
+func (s wsSource) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = s.WriteControl(websocket.CloseMessage, msg, time.Now().Add(s.timeout))
+	return s.Conn.Close()
+}
+
+func dial(cfg *conf.Config, kcp bool) (source, error) {
+	if kcp {
+		conn, err := kcpconn.Dial(cfg.RelayAddr, cfg)
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.WriteMessage([]byte("ready")); err != nil {
+			return nil, err
+		}
+		if topics := cfg.TopicList(); topics != nil {
+			if err := conn.WriteMessage(relay.SubscribeMessage(topics)); err != nil {
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+
+	clientTLS, err := tlsconf.Client(cfg)
+	if err != nil {
+		return nil, err
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = clientTLS
+
+	ws, _, err := dialer.Dial(cfg.RelayURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	ws.WriteMessage(websocket.BinaryMessage, []byte("ready"))
+	if topics := cfg.TopicList(); topics != nil {
+		ws.WriteMessage(websocket.TextMessage, relay.SubscribeMessage(topics))
+	}
+	return wsSource{Conn: ws, timeout: cfg.ShutdownTimeout}, nil
+}
+
+func main() {
+	var (
+		out string
+		kcp bool
+	)
+
+	flag.StringVar(&out, "out", "capture.bin", "file the captured messages are written to")
+	flag.BoolVar(&kcp, "kcp", false, "capture from a KCP relay instead of a websocket one")
+
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Duration)
+		defer cancel()
+	}
+
+	f, err := os.Create(out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	w, err := capture.NewWriter(f)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	src, err := dial(cfg, kcp)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Messages are written as they arrive until the relay goes away, the
+	// message count is reached or the capture is stopped.
+	var count int
+	done := make(chan error, 1)
+	go func() {
+		for cfg.MessageCount == 0 || count < cfg.MessageCount {
+			msg, err := src.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+
+			if err := w.Write(capture.Record{Time: time.Now().UnixNano(), Message: msg}); err != nil {
+				done <- err
+				return
+			}
+			count++
+		}
+		done <- nil
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = src.Close()
+		err = <-done
+	}
+	_ = src.Close()
+	if err != nil && ctx.Err() == nil {
+		log.Println(err)
+	}
+
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("captured %d messages to %v", count, out)
+}
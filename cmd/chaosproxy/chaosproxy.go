@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"go-relay/chaos"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+func main() {
+	var (
+		listen, target string
+		schedule, file string
+		direction      string
+		loop           bool
+		seed           int64
+	)
+
+	flag.StringVar(&listen, "listen", "", "address the proxy accepts connections on")
+	flag.StringVar(&target, "target", "", "address every connection is forwarded to")
+	flag.StringVar(&schedule, "schedule", "", `fault steps, e.g. "30s delay=5ms jitter=2ms; 10s stall; 1m reset-every=10k; 30s rate=1m"`)
+	flag.StringVar(&file, "schedule-file", "", "file of fault steps, one per line, instead of -schedule")
+	flag.StringVar(&direction, "direction", "both", "traffic faults apply to: "+strings.Join(chaos.Directions, ", "))
+	flag.BoolVar(&loop, "loop", false, "start the schedule over after its last step instead of forwarding clean")
+	flag.Int64Var(&seed, "seed", 1, "seed of the jitter")
+	flag.Parse()
+
+	if listen == "" || target == "" {
+		log.Fatal("chaosproxy needs -listen and -target")
+	}
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		schedule = string(b)
+	}
+
+	sched, err := chaos.Parse(schedule)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sched.Loop = loop
+
+	proxy, err := chaos.New(target, sched, direction, seed)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("chaos: proxying %v to %v", ln.Addr(), target)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := proxy.Serve(ctx, ln); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("shutting down")
+}
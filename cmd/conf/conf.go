@@ -1,22 +1,584 @@
 package conf
 
-const (
-	ReadBufferSize  = 0
-	WriteBufferSize = 0
-	MessageChanSize = 2048
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"time"
 
-	SenderThrottleMillis = 20
-	//SenderThrottleMillis = 1000
+	"gopkg.in/yaml.v3"
+)
 
-	PayloadMinBytes = 2 // must be less than max
-	PayloadMaxBytes = 4096
+// EnvPrefix prefixes the environment variable of every setting,
+// e.g. RELAY_MESSAGE_CHAN_SIZE for -message-chan-size.
+const EnvPrefix = "RELAY_"
 
-	IgnoreInitialMessageCount = 100
+// Config holds the benchmark knobs shared by every command.
+type Config struct {
+	ReadBufferSize  int `yaml:"read_buffer_size"`
+	WriteBufferSize int `yaml:"write_buffer_size"`
+	MessageChanSize int `yaml:"message_chan_size"`
 
-	TimestampBytes = 8
+	SubscriberQueueSize int `yaml:"subscriber_queue_size"` // per relay subscriber
+	Subscribers         int `yaml:"subscribers"`           // connections of the gorilla receiver
 
-	RandSeed = 42
+	// What a relay does with a message for a subscriber whose queue is
+	// full, see Backpressures.
+	Backpressure        string `yaml:"backpressure"`
+	DisconnectThreshold int    `yaml:"disconnect_threshold"` // consecutive drops before a disconnect
 
-	UseGosched   = true
-	LockOSThread = false
-)
+	// How a relay redials a lost upstream: after ReconnectMin, doubling up
+	// to ReconnectMax, jittered.
+	Reconnect           bool          `yaml:"reconnect"`
+	ReconnectMin        time.Duration `yaml:"reconnect_min"`
+	ReconnectMax        time.Duration `yaml:"reconnect_max"`
+	ReconnectAttempts   int           `yaml:"reconnect_attempts"`    // 0 retries forever
+	UpstreamIdleTimeout time.Duration `yaml:"upstream_idle_timeout"` // 0 disables
+
+	// Relays append the time each message was read and written to it.
+	HopTimestamps bool `yaml:"hop_timestamps"`
+
+	// How a relay uses several sender addresses, see Failovers.
+	Failover    string `yaml:"failover"`
+	DedupWindow int    `yaml:"dedup_window"` // messages remembered by active failover
+
+	SenderThrottleMillis int `yaml:"sender_throttle_millis"` // ignored with a send rate
+
+	// Open-loop sending, see SendModes.
+	SendRate  float64 `yaml:"send_rate"` // messages per second, 0 disables
+	SendMode  string  `yaml:"send_mode"`
+	BurstSize int     `yaml:"burst_size"`
+
+	// Clock offset estimation between senders and receivers on different
+	// hosts; the skew and drift fake a wrong sender clock for testing.
+	ClockListen   string        `yaml:"clock_listen"` // empty disables
+	ClockAddr     string        `yaml:"clock_addr"`   // empty disables
+	ClockInterval time.Duration `yaml:"clock_interval"`
+	ClockWindow   int           `yaml:"clock_window"`
+	ClockSkew     time.Duration `yaml:"clock_skew"`
+	ClockDriftPPM float64       `yaml:"clock_drift_ppm"`
+
+	// The same for relays, whose hop timestamps receivers compare with the
+	// sender's.
+	RelayClockListen string `yaml:"relay_clock_listen"` // empty disables
+	RelayClockAddr   string `yaml:"relay_clock_addr"`   // empty disables
+
+	// Round trips of messages echoed by receivers straight to senders.
+	EchoListen string `yaml:"echo_listen"` // empty disables
+	EchoAddr   string `yaml:"echo_addr"`   // empty disables
+	EchoWindow int    `yaml:"echo_window"` // sent messages remembered
+
+	// Replaying a capture instead of generating messages.
+	ReplayFile  string  `yaml:"replay_file"`
+	ReplaySpeed float64 `yaml:"replay_speed"` // 0 sends as fast as possible
+
+	// Payload sizes and content, see PayloadSizes and PayloadContents.
+	PayloadSize          string  `yaml:"payload_size"`
+	PayloadContent       string  `yaml:"payload_content"`
+	PayloadMinBytes      int     `yaml:"payload_min_bytes"`
+	PayloadMaxBytes      int     `yaml:"payload_max_bytes"`
+	PayloadBytes         int     `yaml:"payload_bytes"` // fixed size, log-normal median
+	PayloadSigma         float64 `yaml:"payload_sigma"`
+	PayloadLargeFraction float64 `yaml:"payload_large_fraction"`
+
+	IgnoreInitialMessageCount int `yaml:"ignore_initial_message_count"`
+
+	Duration     time.Duration `yaml:"duration"`      // 0 runs until interrupted
+	MessageCount int           `yaml:"message_count"` // 0 runs until interrupted
+
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"` // for draining on SIGINT or SIGTERM
+
+	RandSeed int64 `yaml:"rand_seed"`
+
+	SenderID int `yaml:"sender_id"`
+
+	Topics string `yaml:"topics"` // comma-separated, empty for untagged messages
+
+	UseGosched   bool `yaml:"use_gosched"`
+	LockOSThread bool `yaml:"lock_os_thread"`
+
+	Stack         string `yaml:"stack"`          // recorded in results
+	ResultsFile   string `yaml:"results_file"`   // empty disables results
+	ResultsFormat string `yaml:"results_format"` // jsonl or csv
+
+	MetricsAddr string `yaml:"metrics_addr"` // empty disables /metrics
+
+	// Where senders and relays listen, and where relays and receivers
+	// connect to them. Websocket stacks also use the paths.
+	SenderListen string `yaml:"sender_listen"`
+	SenderAddr   string `yaml:"sender_addr"` // comma-separated for redundant senders
+	SenderPath   string `yaml:"sender_path"`
+	RelayListen  string `yaml:"relay_listen"`
+	RelayAddr    string `yaml:"relay_addr"`
+	RelayPath    string `yaml:"relay_path"`
+
+	// Websocket stacks listen and dial with TLS (wss://). Without a
+	// certificate, listeners serve a self-signed one.
+	TLS           bool   `yaml:"tls"`
+	TLSCert       string `yaml:"tls_cert"` // PEM, presented by listeners and, for mTLS, dialers
+	TLSKey        string `yaml:"tls_key"`
+	TLSCA         string `yaml:"tls_ca"` // PEM, peers are verified against it
+	TLSClientAuth bool   `yaml:"tls_client_auth"`
+	TLSInsecure   bool   `yaml:"tls_insecure"` // dialers accept any certificate
+	TLSVersion    string `yaml:"tls_version"`  // highest version negotiated, see TLSVersions
+
+	KCPNoDelay      bool `yaml:"kcp_nodelay"`
+	KCPInterval     int  `yaml:"kcp_interval"` // milliseconds
+	KCPResend       int  `yaml:"kcp_resend"`
+	KCPNoCongestion bool `yaml:"kcp_no_congestion"`
+	KCPSendWindow   int  `yaml:"kcp_send_window"`
+	KCPRecvWindow   int  `yaml:"kcp_recv_window"`
+	KCPMTU          int  `yaml:"kcp_mtu"`
+	KCPDataShards   int  `yaml:"kcp_data_shards"`   // FEC, 0 disables
+	KCPParityShards int  `yaml:"kcp_parity_shards"` // FEC, 0 disables
+}
+
+// Backpressures lists the relay backpressure policies:
+//
+//   - drop-newest drops the message.
+//   - drop-oldest drops the oldest queued message to make room.
+//   - block waits for room, which stalls every subscriber and the upstream.
+//   - conflate replaces a queued message of the same topic and sender.
+//   - disconnect drops the message and closes the subscriber once
+//     disconnect-threshold messages in a row were dropped.
+var Backpressures = []string{"drop-newest", "drop-oldest", "block", "conflate", "disconnect"}
+
+// Failovers lists how a relay reads from several senders:
+//
+//   - standby reads one and moves on to the next when it is lost.
+//   - active reads all of them and forwards the first copy of each message,
+//     by sender ID, topic and sequence number.
+var Failovers = []string{"standby", "active"}
+
+// SendModes lists how an open-loop sender spaces its messages at send-rate:
+//
+//   - constant sends them at fixed intervals.
+//   - poisson draws exponential intervals, like independent clients.
+//   - burst sends burst-size messages at once, then waits as long as they
+//     would have taken.
+var SendModes = []string{"constant", "poisson", "burst"}
+
+// PayloadSizes lists the payload size distributions:
+//
+//   - fixed is always payload-bytes.
+//   - uniform is spread evenly from payload-min-bytes up to
+//     payload-max-bytes.
+//   - lognormal clusters around payload-bytes with a long tail, spread by
+//     payload-sigma and clamped to the min and max.
+//   - bimodal is payload-min-bytes, or payload-max-bytes for a
+//     payload-large-fraction of the messages.
+var PayloadSizes = []string{"fixed", "uniform", "lognormal", "bimodal"}
+
+// PayloadContents lists what payloads are filled with, from incompressible
+// to highly compressible: random bytes, JSON market-data ticks, repetitive
+// text and zeros.
+var PayloadContents = []string{"random", "json", "text", "zeros"}
+
+// TLSVersions lists the highest TLS versions roles can be held to.
+var TLSVersions = []string{"1.2", "1.3"}
+
+// Default returns the configuration used when nothing is overridden.
+func Default() *Config {
+	return &Config{
+		ReadBufferSize:  0,
+		WriteBufferSize: 0,
+		MessageChanSize: 2048,
+
+		SubscriberQueueSize: 1024,
+		Subscribers:         1,
+
+		Backpressure:        "drop-newest",
+		DisconnectThreshold: 1024,
+
+		Reconnect:    true,
+		ReconnectMin: 100 * time.Millisecond,
+		ReconnectMax: 5 * time.Second,
+
+		Failover:    "standby",
+		DedupWindow: 1 << 16,
+
+		SenderThrottleMillis: 20,
+
+		SendMode:  "constant",
+		BurstSize: 10,
+
+		ReplaySpeed: 1,
+
+		ClockInterval: time.Second,
+		ClockWindow:   64,
+
+		EchoWindow: 1 << 16,
+
+		PayloadSize:          "uniform",
+		PayloadContent:       "random",
+		PayloadMinBytes:      2,
+		PayloadMaxBytes:      4096,
+		PayloadBytes:         256,
+		PayloadSigma:         1,
+		PayloadLargeFraction: 0.1,
+
+		IgnoreInitialMessageCount: 100,
+
+		ShutdownTimeout: 5 * time.Second,
+
+		RandSeed: 42,
+
+		SenderID: 1,
+
+		UseGosched:   true,
+		LockOSThread: false,
+
+		ResultsFormat: "jsonl",
+
+		SenderListen: ":8080",
+		SenderAddr:   "127.0.0.1:8080",
+		SenderPath:   "/sender",
+		RelayListen:  ":8081",
+		RelayAddr:    "127.0.0.1:8081",
+		RelayPath:    "/relay",
+
+		TLSVersion: "1.3",
+
+		KCPNoDelay:      true,
+		KCPInterval:     10,
+		KCPResend:       2,
+		KCPNoCongestion: true,
+		KCPSendWindow:   1024,
+		KCPRecvWindow:   1024,
+		KCPMTU:          1400,
+	}
+}
+
+type setting struct {
+	name  string
+	value any
+	usage string
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"read-buffer-size", &c.ReadBufferSize, "websocket read buffer size, 0 uses the library default"},
+		{"write-buffer-size", &c.WriteBufferSize, "websocket write buffer size, 0 uses the library default"},
+		{"message-chan-size", &c.MessageChanSize, "capacity of the internal message channels"},
+		{"subscriber-queue-size", &c.SubscriberQueueSize, "messages a relay queues for each subscriber before dropping"},
+		{"subscribers", &c.Subscribers, "connections the gorilla receiver opens to the relay, each a separate subscriber"},
+		{"backpressure", &c.Backpressure, "relay policy for a subscriber whose queue is full: " + strings.Join(Backpressures, ", ")},
+		{"disconnect-threshold", &c.DisconnectThreshold, "consecutive drops after which the disconnect backpressure policy closes a subscriber"},
+		{"reconnect", &c.Reconnect, "relays redial a lost upstream instead of exiting"},
+		{"reconnect-min", &c.ReconnectMin, "delay before the first redial of a lost upstream"},
+		{"reconnect-max", &c.ReconnectMax, "longest delay between redials of a lost upstream"},
+		{"reconnect-attempts", &c.ReconnectAttempts, "failed redials after which a relay gives up, 0 retries forever"},
+		{"upstream-idle-timeout", &c.UpstreamIdleTimeout, "relays drop an upstream that sent nothing for this long, 0 disables"},
+		{"hop-timestamps", &c.HopTimestamps, "relays append when they read and wrote each message, for a latency breakdown at receivers"},
+		{"failover", &c.Failover, "how relays use redundant senders: " + strings.Join(Failovers, ", ")},
+		{"dedup-window", &c.DedupWindow, "messages the active failover mode remembers to drop later copies"},
+		{"sender-throttle-millis", &c.SenderThrottleMillis, "sleep between sent messages, 0 disables throttling; ignored with send-rate"},
+		{"send-rate", &c.SendRate, "messages per second an open-loop sender schedules, 0 keeps the closed loop"},
+		{"send-mode", &c.SendMode, "how an open-loop sender spaces messages: " + strings.Join(SendModes, ", ")},
+		{"burst-size", &c.BurstSize, "messages sent at once by the burst send mode"},
+		{"clock-listen", &c.ClockListen, "UDP address senders serve their clock on for receivers on other hosts, empty disables"},
+		{"clock-addr", &c.ClockAddr, "UDP address of the sender clock receivers correct latencies with, empty disables"},
+		{"clock-interval", &c.ClockInterval, "time between the clock probes of receivers"},
+		{"clock-window", &c.ClockWindow, "latest clock probes receivers estimate offset and drift from"},
+		{"clock-skew", &c.ClockSkew, "offset added to the clock senders stamp and serve, for testing"},
+		{"clock-drift-ppm", &c.ClockDriftPPM, "drift added to the clock senders stamp and serve, in parts per million, for testing"},
+		{"relay-clock-listen", &c.RelayClockListen, "UDP address relays serve their clock on for receivers placing hop timestamps, empty disables"},
+		{"relay-clock-addr", &c.RelayClockAddr, "UDP address of the relay clock receivers place hop timestamps with, empty assumes the sender's"},
+		{"echo-listen", &c.EchoListen, "UDP address senders answer the echoes of receivers on with round trips, empty disables"},
+		{"echo-addr", &c.EchoAddr, "UDP address of the sender receivers echo every message to, empty disables"},
+		{"echo-window", &c.EchoWindow, "sent messages a sender remembers to answer echoes"},
+		{"replay-file", &c.ReplayFile, "senders replay the payloads and timing of this capture, in a loop, empty disables"},
+		{"replay-speed", &c.ReplaySpeed, "replay timing scale: 1 keeps the captured timing, 2 doubles the rate, 0 sends as fast as possible"},
+		{"payload-size", &c.PayloadSize, "payload size distribution: " + strings.Join(PayloadSizes, ", ")},
+		{"payload-content", &c.PayloadContent, "what payloads are filled with: " + strings.Join(PayloadContents, ", ")},
+		{"payload-min-bytes", &c.PayloadMinBytes, "smallest payload size"},
+		{"payload-max-bytes", &c.PayloadMaxBytes, "largest payload size, exclusive for uniform sizes"},
+		{"payload-bytes", &c.PayloadBytes, "size of fixed payloads and median of log-normal ones"},
+		{"payload-sigma", &c.PayloadSigma, "spread of log-normal payload sizes, the standard deviation of their logarithm"},
+		{"payload-large-fraction", &c.PayloadLargeFraction, "share of large payloads with bimodal sizes, from 0 to 1"},
+		{"ignore-initial-message-count", &c.IgnoreInitialMessageCount, "messages to discard before measuring latency"},
+		{"duration", &c.Duration, "receivers stop and print a final report after this long, 0 runs forever"},
+		{"message-count", &c.MessageCount, "receivers stop and print a final report after measuring this many messages, 0 runs forever"},
+		{"shutdown-timeout", &c.ShutdownTimeout, "how long a role drains its messages and connections after SIGINT or SIGTERM"},
+		{"rand-seed", &c.RandSeed, "seed of the payload generator"},
+		{"sender-id", &c.SenderID, "ID senders put in every envelope"},
+		{"topics", &c.Topics, "comma-separated topics senders publish to in turn and receivers subscribe to, empty for one untagged stream"},
+		{"use-gosched", &c.UseGosched, "yield with runtime.Gosched in busy loops"},
+		{"lock-os-thread", &c.LockOSThread, "pin hot loops to an OS thread"},
+		{"stack", &c.Stack, "stack name recorded in results"},
+		{"results-file", &c.ResultsFile, "receivers append interval and final results to this file, empty disables"},
+		{"results-format", &c.ResultsFormat, "format of the results file, jsonl or csv"},
+		{"metrics-addr", &c.MetricsAddr, "serve Prometheus metrics at /metrics on this address, empty disables"},
+		{"sender-listen", &c.SenderListen, "address senders listen on"},
+		{"sender-addr", &c.SenderAddr, "address relays connect to the sender at, comma-separated for redundant senders"},
+		{"sender-path", &c.SenderPath, "websocket path of senders"},
+		{"relay-listen", &c.RelayListen, "address relays listen on"},
+		{"relay-addr", &c.RelayAddr, "address receivers connect to the relay at"},
+		{"relay-path", &c.RelayPath, "websocket path of relays"},
+		{"tls", &c.TLS, "websocket stacks listen and dial with TLS (wss://)"},
+		{"tls-cert", &c.TLSCert, "PEM certificate listeners present, and dialers for mTLS; listeners generate a self-signed one when empty"},
+		{"tls-key", &c.TLSKey, "PEM key of tls-cert"},
+		{"tls-ca", &c.TLSCA, "PEM CA certificates peers are verified against, empty uses the system roots"},
+		{"tls-client-auth", &c.TLSClientAuth, "listeners require client certificates signed by tls-ca (mTLS)"},
+		{"tls-insecure", &c.TLSInsecure, "dialers accept any server certificate, for self-signed listeners"},
+		{"tls-version", &c.TLSVersion, "highest TLS version negotiated: " + strings.Join(TLSVersions, ", ")},
+		{"kcp-nodelay", &c.KCPNoDelay, "KCP nodelay mode"},
+		{"kcp-interval", &c.KCPInterval, "KCP internal update interval in milliseconds"},
+		{"kcp-resend", &c.KCPResend, "KCP fast resend after this many duplicate ACKs, 0 disables"},
+		{"kcp-no-congestion", &c.KCPNoCongestion, "disable KCP congestion control"},
+		{"kcp-send-window", &c.KCPSendWindow, "KCP send window in packets"},
+		{"kcp-recv-window", &c.KCPRecvWindow, "KCP receive window in packets"},
+		{"kcp-mtu", &c.KCPMTU, "KCP MTU in bytes"},
+		{"kcp-data-shards", &c.KCPDataShards, "KCP FEC data shards, 0 disables FEC"},
+		{"kcp-parity-shards", &c.KCPParityShards, "KCP FEC parity shards, 0 disables FEC"},
+	}
+}
+
+// Load builds the configuration from defaults, an optional config file,
+// environment variables and command line flags, in increasing order of
+// precedence. Flags are registered on flag.CommandLine, so commands can
+// define their own flags before calling Load.
+func Load() (*Config, error) {
+	return LoadArgs(flag.CommandLine, os.Args[1:])
+}
+
+// LoadArgs is Load for an explicit flag set and argument list.
+func LoadArgs(fs *flag.FlagSet, args []string) (*Config, error) {
+	c := Default()
+
+	path := os.Getenv(EnvPrefix + "CONFIG")
+	if p, ok := lookupArg(args, "config"); ok {
+		path = p
+	}
+	if path != "" {
+		if err := c.LoadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.String("config", path, "YAML or JSON config file, also read from "+EnvPrefix+"CONFIG")
+	c.RegisterFlags(fs)
+
+	// Environment values go through the flag parsers so every type is
+	// handled the same way; flags parsed afterwards take precedence.
+	for _, s := range c.settings() {
+		key := EnvName(s.name)
+		v, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		if err := fs.Set(s.name, v); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	return c, c.Validate()
+}
+
+// LoadFile overlays the settings found in a YAML or JSON file.
+func (c *Config) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// RegisterFlags defines a flag for every setting, defaulting to the current values.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	for _, s := range c.settings() {
+		usage := s.usage + " (" + EnvName(s.name) + ")"
+
+		switch v := s.value.(type) {
+		case *int:
+			fs.IntVar(v, s.name, *v, usage)
+		case *int64:
+			fs.Int64Var(v, s.name, *v, usage)
+		case *float64:
+			fs.Float64Var(v, s.name, *v, usage)
+		case *bool:
+			fs.BoolVar(v, s.name, *v, usage)
+		case *string:
+			fs.StringVar(v, s.name, *v, usage)
+		case *time.Duration:
+			fs.DurationVar(v, s.name, *v, usage)
+		default:
+			panic(fmt.Sprintf("conf: unsupported setting type %T", v))
+		}
+	}
+}
+
+// Validate reports the first setting that cannot be used.
+func (c *Config) Validate() error {
+	switch {
+	case c.ReadBufferSize < 0 || c.WriteBufferSize < 0:
+		return errors.New("buffer sizes must not be negative")
+	case c.MessageChanSize < 0:
+		return errors.New("message-chan-size must not be negative")
+	case c.SubscriberQueueSize < 1:
+		return errors.New("subscriber-queue-size must be positive")
+	case c.Subscribers < 1:
+		return errors.New("subscribers must be positive")
+	case !slices.Contains(Backpressures, c.Backpressure):
+		return errors.New("backpressure must be one of " + strings.Join(Backpressures, ", "))
+	case c.DisconnectThreshold < 1:
+		return errors.New("disconnect-threshold must be positive")
+	case c.ReconnectMin <= 0 || c.ReconnectMax < c.ReconnectMin:
+		return errors.New("reconnect-min must be positive and not above reconnect-max")
+	case c.ReconnectAttempts < 0 || c.UpstreamIdleTimeout < 0:
+		return errors.New("reconnect-attempts and upstream-idle-timeout must not be negative")
+	case !slices.Contains(Failovers, c.Failover):
+		return errors.New("failover must be one of " + strings.Join(Failovers, ", "))
+	case c.DedupWindow < 1:
+		return errors.New("dedup-window must be positive")
+	case c.SenderThrottleMillis < 0:
+		return errors.New("sender-throttle-millis must not be negative")
+	case c.SendRate < 0:
+		return errors.New("send-rate must not be negative")
+	case !slices.Contains(SendModes, c.SendMode):
+		return errors.New("send-mode must be one of " + strings.Join(SendModes, ", "))
+	case c.BurstSize < 1:
+		return errors.New("burst-size must be positive")
+	case c.ClockInterval <= 0 || c.ClockWindow < 2:
+		return errors.New("clock-interval must be positive and clock-window at least 2")
+	case c.EchoWindow < 1:
+		return errors.New("echo-window must be positive")
+	case c.ReplaySpeed < 0:
+		return errors.New("replay-speed must not be negative")
+	case c.ReplayFile != "" && c.SendRate > 0:
+		return errors.New("replay-file and send-rate cannot be combined")
+	case !slices.Contains(PayloadSizes, c.PayloadSize):
+		return errors.New("payload-size must be one of " + strings.Join(PayloadSizes, ", "))
+	case !slices.Contains(PayloadContents, c.PayloadContent):
+		return errors.New("payload-content must be one of " + strings.Join(PayloadContents, ", "))
+	case c.PayloadMinBytes < 0:
+		return errors.New("payload-min-bytes must not be negative")
+	case c.PayloadMaxBytes <= c.PayloadMinBytes:
+		return errors.New("payload-max-bytes must be greater than payload-min-bytes")
+	case c.PayloadBytes < 0:
+		return errors.New("payload-bytes must not be negative")
+	case c.PayloadSigma < 0:
+		return errors.New("payload-sigma must not be negative")
+	case c.PayloadLargeFraction < 0 || c.PayloadLargeFraction > 1:
+		return errors.New("payload-large-fraction must be between 0 and 1")
+	case c.IgnoreInitialMessageCount < 0:
+		return errors.New("ignore-initial-message-count must not be negative")
+	case c.Duration < 0 || c.MessageCount < 0:
+		return errors.New("duration and message-count must not be negative")
+	case c.ShutdownTimeout <= 0:
+		return errors.New("shutdown-timeout must be positive")
+	case c.SenderID < 0 || c.SenderID > math.MaxUint32:
+		return errors.New("sender-id must fit in 32 bits")
+	case c.ResultsFormat != "jsonl" && c.ResultsFormat != "csv":
+		return errors.New("results-format must be jsonl or csv")
+	case slices.Contains(c.TopicList(), ""):
+		return errors.New("topics must not be empty")
+	case c.SenderListen == "" || slices.Contains(c.SenderAddrs(), "") || c.RelayListen == "" || c.RelayAddr == "":
+		return errors.New("sender and relay addresses must not be empty")
+	case !strings.HasPrefix(c.SenderPath, "/") || !strings.HasPrefix(c.RelayPath, "/"):
+		return errors.New("sender-path and relay-path must start with /")
+	case (c.TLSCert == "") != (c.TLSKey == ""):
+		return errors.New("tls-cert and tls-key must be set together")
+	case !slices.Contains(TLSVersions, c.TLSVersion):
+		return errors.New("tls-version must be one of " + strings.Join(TLSVersions, ", "))
+	case c.KCPInterval < 1 || c.KCPResend < 0:
+		return errors.New("kcp-interval must be positive and kcp-resend not negative")
+	case c.KCPSendWindow < 1 || c.KCPRecvWindow < 1:
+		return errors.New("kcp windows must be positive")
+	case c.KCPMTU < 50:
+		return errors.New("kcp-mtu must be at least 50")
+	case c.KCPDataShards < 0 || c.KCPParityShards < 0 || (c.KCPDataShards == 0) != (c.KCPParityShards == 0):
+		return errors.New("kcp-data-shards and kcp-parity-shards must both be set to enable FEC")
+	}
+
+	return nil
+}
+
+// Throttled reports whether closed-loop senders sleep between messages.
+func (c *Config) Throttled() bool {
+	return c.SenderThrottleMillis > 0 && c.SendRate == 0 && c.ReplayFile == ""
+}
+
+// SenderThrottle is SenderThrottleMillis as a duration.
+func (c *Config) SenderThrottle() time.Duration {
+	return time.Duration(c.SenderThrottleMillis) * time.Millisecond
+}
+
+// TopicList splits Topics, returning nil when it is empty.
+func (c *Config) TopicList() []string {
+	if c.Topics == "" {
+		return nil
+	}
+	return strings.Split(c.Topics, ",")
+}
+
+// SenderAddrs splits SenderAddr.
+func (c *Config) SenderAddrs() []string {
+	return strings.Split(c.SenderAddr, ",")
+}
+
+// SenderURLs are the websocket URLs relays dial, one per sender address.
+func (c *Config) SenderURLs() []string {
+	addrs := c.SenderAddrs()
+	urls := make([]string, len(addrs))
+	for i, addr := range addrs {
+		urls[i] = c.scheme() + addr + c.SenderPath
+	}
+	return urls
+}
+
+// RelayURL is the websocket URL receivers dial.
+func (c *Config) RelayURL() string {
+	return c.scheme() + c.RelayAddr + c.RelayPath
+}
+
+func (c *Config) scheme() string {
+	if c.TLS {
+		return "wss://"
+	}
+	return "ws://"
+}
+
+// EnvName returns the environment variable for a flag name.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// lookupArg finds the value of a flag before the flag set is parsed.
+func lookupArg(args []string, name string) (string, bool) {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+
+		arg = strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if arg == name && i+1 < len(args) {
+			return args[i+1], true
+		}
+		if v, ok := strings.CutPrefix(arg, name+"="); ok {
+			return v, true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,204 @@
+package conf
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func load(args ...string) (*Config, error) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return LoadArgs(fs, args)
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "relay.yaml", "message_chan_size: 10\nbackpressure: drop-oldest\n")
+
+	tests := []struct {
+		name         string
+		file, env    bool
+		flag         bool
+		wantSize     int
+		wantPressure string
+	}{
+		{name: "defaults", wantSize: Default().MessageChanSize, wantPressure: Default().Backpressure},
+		{name: "file", file: true, wantSize: 10, wantPressure: "drop-oldest"},
+		{name: "env over file", file: true, env: true, wantSize: 20, wantPressure: "drop-oldest"},
+		{name: "env", env: true, wantSize: 20, wantPressure: Default().Backpressure},
+		{name: "flag over env", env: true, flag: true, wantSize: 30, wantPressure: Default().Backpressure},
+		{name: "flag over all", file: true, env: true, flag: true, wantSize: 30, wantPressure: "drop-oldest"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []string
+			if tt.file {
+				args = append(args, "-config", file)
+			}
+			if tt.env {
+				t.Setenv(EnvName("message-chan-size"), "20")
+			}
+			if tt.flag {
+				args = append(args, "-message-chan-size=30")
+			}
+
+			c, err := load(args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.MessageChanSize != tt.wantSize || c.Backpressure != tt.wantPressure {
+				t.Errorf("message-chan-size %v, backpressure %v, want %v, %v",
+					c.MessageChanSize, c.Backpressure, tt.wantSize, tt.wantPressure)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPath(t *testing.T) {
+	file := writeFile(t, "relay.yaml", "subscribers: 7\n")
+	envFile := writeFile(t, "env.yaml", "subscribers: 3\n")
+
+	tests := []struct {
+		name string
+		env  string
+		args []string
+		want int
+	}{
+		{name: "separate value", args: []string{"-config", file}, want: 7},
+		{name: "equals", args: []string{"-config=" + file}, want: 7},
+		{name: "double dash", args: []string{"--config=" + file}, want: 7},
+		{name: "env", env: envFile, want: 3},
+		{name: "flag over env", env: envFile, args: []string{"-config", file}, want: 7},
+		{name: "after the flags", args: []string{"-subscribers=1", "--", "-config", file}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv(EnvPrefix+"CONFIG", tt.env)
+			}
+			c, err := load(tt.args...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Subscribers != tt.want {
+				t.Errorf("subscribers %v, want %v", c.Subscribers, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "empty"},
+		{name: "yaml", content: "failover: active\ndedup_window: 8\n"},
+		{name: "json", content: `{"failover": "active", "dedup_window": 8}`},
+		{name: "unknown key", content: "failover: active\nfail_over: standby\n", wantErr: "field fail_over not found"},
+		{name: "wrong type", content: "dedup_window: many\n", wantErr: "cannot unmarshal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeFile(t, "c.yaml", tt.content)
+
+			c := Default()
+			err := c.LoadFile(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error with %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.content != "" && (c.Failover != "active" || c.DedupWindow != 8) {
+				t.Errorf("failover %v, dedup-window %v", c.Failover, c.DedupWindow)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	t.Run("bad env", func(t *testing.T) {
+		t.Setenv(EnvName("subscribers"), "lots")
+		if _, err := load(); err == nil || !strings.Contains(err.Error(), EnvName("subscribers")) {
+			t.Errorf("got %v, want an error naming the variable", err)
+		}
+	})
+	t.Run("missing file", func(t *testing.T) {
+		if _, err := load("-config", filepath.Join(t.TempDir(), "none.yaml")); err == nil {
+			t.Error("loaded a missing config file")
+		}
+	})
+	t.Run("invalid", func(t *testing.T) {
+		if _, err := load("-backpressure", "drop-all"); err == nil {
+			t.Error("loaded an invalid config")
+		}
+	})
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     func(c *Config)
+		wantErr string
+	}{
+		{name: "defaults", set: func(*Config) {}},
+		{name: "every backpressure", set: func(c *Config) {
+			for _, b := range Backpressures {
+				c.Backpressure = b
+			}
+		}},
+		{name: "bad backpressure", set: func(c *Config) { c.Backpressure = "drop" }, wantErr: "backpressure must be one of"},
+		{name: "empty backpressure", set: func(c *Config) { c.Backpressure = "" }, wantErr: "backpressure must be one of"},
+		{name: "bad failover", set: func(c *Config) { c.Failover = "passive" }, wantErr: "failover must be one of"},
+		{name: "bad send mode", set: func(c *Config) { c.SendMode = "random" }, wantErr: "send-mode must be one of"},
+		{name: "bad results format", set: func(c *Config) { c.ResultsFormat = "xml" }, wantErr: "results-format"},
+		{name: "replay at a rate", set: func(c *Config) { c.ReplayFile, c.SendRate = "x.cap", 10 }, wantErr: "cannot be combined"},
+		{name: "half a key pair", set: func(c *Config) { c.TLSCert = "cert.pem" }, wantErr: "set together"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.set(c)
+			err := c.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got %v, want an error with %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	for _, f := range Failovers {
+		c := Default()
+		c.Failover = f
+		if err := c.Validate(); err != nil {
+			t.Errorf("failover %v: %v", f, err)
+		}
+	}
+}
@@ -1,27 +1,51 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/lxzan/gws"
 	"go-relay/cmd/conf"
+	"go-relay/metrics"
+	"go-relay/relay"
+	"go-relay/stats"
+	"go-relay/tlsconf"
 	"log"
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 	"time"
 )
 
-type MessageLatency struct {
-	msg        []byte
-	recvNanoTS uint64
-}
-
 func main() {
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
+
+	collector, err := stats.NewCollector(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(sigCtx)
 	ws := &WebSocket{
-		messageChan: make(chan MessageLatency, conf.MessageChanSize),
+		collector: collector,
+		cancel:    cancel,
+	}
+
+	clientTLS, err := tlsconf.Client(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	socket, _, err := gws.NewClient(ws, &gws.ClientOption{
-		Addr: "ws://127.0.0.1:8081/relay",
+		Addr:      cfg.RelayURL(),
+		TlsConfig: clientTLS,
 		PermessageDeflate: gws.PermessageDeflate{
 			Enabled:               true,
 			ServerContextTakeover: true,
@@ -29,9 +53,12 @@ func main() {
 		},
 	})
 	if err != nil {
-		log.Printf(err.Error())
+		log.Println(err)
 		return
 	}
+	if tc, ok := socket.NetConn().(*tls.Conn); ok {
+		collector.SetTLS(tc.ConnectionState())
+	}
 
 	go func() {
 		socket.ReadLoop()
@@ -40,25 +67,32 @@ func main() {
 	time.Sleep(100 * time.Millisecond)
 
 	socket.WriteString("ready")
+	if topics := cfg.TopicList(); topics != nil {
+		socket.WriteMessage(gws.OpcodeText, relay.SubscribeMessage(topics))
+	}
 
 	go func() {
 		for {
-			if conf.UseGosched {
+			if cfg.UseGosched {
 				runtime.Gosched()
 			}
 		}
 	}()
 
-	// run forever
-	select {}
+	ws.collector.Run(ctx)
+
+	// Sends a close frame and closes the connection.
+	_ = socket.WriteClose(1000, nil)
 }
 
 type WebSocket struct {
-	messageChan chan MessageLatency
+	collector *stats.Collector
+	cancel    context.CancelFunc
 }
 
 func (c *WebSocket) OnClose(socket *gws.Conn, err error) {
 	fmt.Printf("onerror: err=%s\n", err.Error())
+	c.cancel()
 }
 
 func (c *WebSocket) OnPong(socket *gws.Conn, payload []byte) {
@@ -66,8 +100,6 @@ func (c *WebSocket) OnPong(socket *gws.Conn, payload []byte) {
 
 func (c *WebSocket) OnOpen(socket *gws.Conn) {
 	_ = socket.WriteString("hello, there is client")
-
-	go c.TimeMessages()
 }
 
 func (c *WebSocket) OnPing(socket *gws.Conn, payload []byte) {
@@ -79,85 +111,6 @@ func (c *WebSocket) OnMessage(socket *gws.Conn, message *gws.Message) {
 
 	recvNanoTS := time.Now().UnixNano()
 
-	ml := MessageLatency{
-		msg:        message.Data.Bytes(),
-		recvNanoTS: uint64(recvNanoTS),
-	}
-
-	select {
-	case c.messageChan <- ml:
-	default:
-		fmt.Println("receiver chan full")
-	}
-}
-
-func (c *WebSocket) TimeMessages() {
-	if conf.LockOSThread {
-		runtime.LockOSThread()
-		defer runtime.UnlockOSThread()
-	}
-
-	var (
-		minLatency  uint64
-		maxLatency  uint64
-		total       uint64
-		lastLatency uint64
-		count       uint64
-	)
-
-	ticker := time.NewTicker(time.Second)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ticker.C:
-			nowTimeStr := time.Now().Format(time.DateTime)
-			if count < conf.IgnoreInitialMessageCount {
-				fmt.Printf(
-					"%v: Ignoring initial messages, count=%v/%v\n",
-					nowTimeStr,
-					count,
-					conf.IgnoreInitialMessageCount,
-				)
-				continue
-			}
-
-			fmt.Printf(
-				"%v:  SampleLatency: %v | Min: %v | Max: %v | Avg: %v | Count: %v| UseGosched: %v\n",
-				nowTimeStr,
-				time.Duration(lastLatency),
-				time.Duration(minLatency),
-				time.Duration(maxLatency),
-				time.Duration(total/count),
-				count,
-				conf.UseGosched,
-			)
-		case ml := <-c.messageChan:
-			count++
-			if count < conf.IgnoreInitialMessageCount {
-				continue
-			}
-
-			msg := ml.msg
-
-			ts := binary.LittleEndian.Uint64(msg[:conf.TimestampBytes])
-
-			latencyNanos := ml.recvNanoTS - ts
-
-			// TODO fix overflow - threshold one hour
-			if latencyNanos > 3_600_000_000_000 {
-				latencyNanos = lastLatency
-			}
-
-			// Update metrics
-			if minLatency == 0 || latencyNanos < minLatency {
-				minLatency = latencyNanos
-			}
-			if latencyNanos > maxLatency {
-				maxLatency = latencyNanos
-			}
-			total += latencyNanos
-			lastLatency = latencyNanos
-		}
-	}
+	// The message buffer returns to a pool on Close, so copy it out.
+	c.collector.Offer(append([]byte(nil), message.Data.Bytes()...), recvNanoTS)
 }
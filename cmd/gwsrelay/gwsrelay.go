@@ -1,132 +1,78 @@
 package main
 
 import (
-	"fmt"
-	"github.com/lxzan/gws"
+	"context"
+	"go-relay/clock"
 	"go-relay/cmd/conf"
+	"go-relay/metrics"
+	"go-relay/relay"
+	"go-relay/tlsconf"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
-	"time"
+	"syscall"
 )
 
 func main() {
-	upgrader := gws.NewUpgrader(&Relay{}, &gws.ServerOption{
-		ParallelEnabled:   true,                                 // Parallel message processing
-		Recovery:          gws.Recovery,                         // Exception recovery
-		PermessageDeflate: gws.PermessageDeflate{Enabled: true}, // Enable compression
-	})
-	http.HandleFunc("/relay", func(writer http.ResponseWriter, request *http.Request) {
-		socket, err := upgrader.Upgrade(writer, request)
-		if err != nil {
-			return
-		}
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
+
+	// Hop timestamps are read off the system clock.
+	if cfg.RelayClockListen != "" {
 		go func() {
-			socket.ReadLoop() // Blocking prevents the context from being GC.
+			log.Fatal(clock.Serve(cfg.RelayClockListen, new(clock.Clock)))
 		}()
-	})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	go func() {
 		for {
-			if conf.UseGosched {
+			if cfg.UseGosched {
 				runtime.Gosched()
 			}
 		}
 	}()
 
-	http.ListenAndServe(":8081", nil)
-}
-
-type Relay struct {
-}
-
-func (r *Relay) OnOpen(socket *gws.Conn) {}
-
-func (r *Relay) OnClose(socket *gws.Conn, err error) {}
-
-func (r *Relay) OnPing(socket *gws.Conn, payload []byte) {}
-
-func (r *Relay) OnPong(socket *gws.Conn, payload []byte) {}
-
-func (r *Relay) OnMessage(socket *gws.Conn, message *gws.Message) {
-	defer message.Close()
-
-	//fmt.Printf("onMessage: %v\n", message.Data)
-
-	// Forward from receiver to sender
-	if message.Data.String() == "ready" {
-		fmt.Println("Client sent ready")
-
-		connectSender(socket)
-	}
-}
-
-func connectSender(receiver *gws.Conn) {
-	ws := &Sender{
-		messageChan: make(chan []byte, conf.MessageChanSize),
-		receiver:    receiver,
+	clientTLS, err := tlsconf.Client(cfg)
+	if err != nil {
+		log.Fatal(err)
 	}
-
-	socket, _, err := gws.NewClient(ws, &gws.ClientOption{
-		Addr: "ws://127.0.0.1:8080/sender",
-		PermessageDeflate: gws.PermessageDeflate{
-			Enabled:               true,
-			ServerContextTakeover: true,
-			ClientContextTakeover: true,
-		},
-	})
+	serverTLS, err := tlsconf.Server(cfg)
 	if err != nil {
-		log.Printf(err.Error())
-		return
+		log.Fatal(err)
 	}
 
-	go func() {
-		ws.ForwardMessageLoop()
-	}()
-
-	go func() {
-		socket.ReadLoop()
-	}()
-
-	time.Sleep(100 * time.Millisecond)
-
-	socket.WriteString("ready")
-}
-
-type Sender struct {
-	messageChan chan []byte
-	receiver    *gws.Conn
-}
-
-func (c *Sender) OnClose(socket *gws.Conn, err error) {}
-
-func (c *Sender) OnPong(socket *gws.Conn, payload []byte) {}
-
-func (c *Sender) OnOpen(socket *gws.Conn) {}
-
-func (c *Sender) OnPing(socket *gws.Conn, payload []byte) {}
-
-func (c *Sender) OnMessage(socket *gws.Conn, message *gws.Message) {
-	defer message.Close()
-
-	select {
-	case c.messageChan <- message.Data.Bytes():
-	default:
-		fmt.Println("message chan full")
+	var ups []relay.Upstream
+	for _, url := range cfg.SenderURLs() {
+		u := relay.NewGWSUpstream(url)
+		u.TLSConfig = clientTLS
+		ups = append(ups, u)
 	}
 
-	//c.receiver.WriteMessage(gws.OpcodeBinary, message.Data.Bytes())
+	down := relay.NewGWSDownstream(cfg.RelayListen, cfg.RelayPath)
+	down.TLSConfig = serverTLS
 
-}
-
-func (c *Sender) ForwardMessageLoop() {
-	if conf.LockOSThread {
-		runtime.LockOSThread()
-		defer runtime.UnlockOSThread()
+	r := relay.New(cfg, ups, down)
+	if err := r.Start(context.Background()); err != nil {
+		log.Fatal(err)
 	}
 
-	for {
-		msg := <-c.messageChan
-		c.receiver.WriteMessage(gws.OpcodeBinary, msg)
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		if err := r.Shutdown(shutdownCtx); err != nil {
+			log.Println("shutdown:", err)
+		}
+		cancel()
+	case <-r.Done():
 	}
+
+	r.Wait()
 }
@@ -1,46 +1,214 @@
 package main
 
 import (
-	"encoding/binary"
+	"context"
 	"fmt"
 	"github.com/lxzan/gws"
+	"go-relay/capture"
+	"go-relay/clock"
 	"go-relay/cmd/conf"
-	"math/rand"
+	"go-relay/echo"
+	"go-relay/envelope"
+	"go-relay/metrics"
+	"go-relay/pacer"
+	"go-relay/payload"
+	"go-relay/tlsconf"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
+var (
+	sentTotal   = metrics.NewCounter("sender_messages_sent_total", "Messages written to relays.")
+	connections = metrics.NewGauge("sender_connections", "Connected relays.")
+)
+
 const (
 	PingInterval = 5 * time.Second
 	PingWait     = 10 * time.Second
 )
 
+// closedKey holds, in a connection's session, the channel OnClose closes.
+const closedKey = "closed"
+
 func main() {
-	upgrader := gws.NewUpgrader(&Handler{}, &gws.ServerOption{
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
+
+	replay, err := capture.LoadReplay(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clk := clock.FromConfig(cfg)
+	if cfg.ClockListen != "" {
+		go func() {
+			log.Fatal(clock.Serve(cfg.ClockListen, clk))
+		}()
+	}
+
+	var rtt *echo.Tracker
+	if cfg.EchoListen != "" {
+		rtt = echo.NewTracker(cfg.EchoWindow)
+		go func() {
+			log.Fatal(rtt.Serve(cfg.EchoListen))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	handler := &Handler{
+		cfg:         cfg,
+		clk:         clk,
+		rtt:         rtt,
+		messageChan: make(chan []byte, cfg.MessageChanSize),
+		connected:   make(chan struct{}),
+	}
+	go handler.generate(ctx, replay)
+
+	upgrader := gws.NewUpgrader(handler, &gws.ServerOption{
 		ParallelEnabled:   true,                                 // Parallel message processing
 		Recovery:          gws.Recovery,                         // Exception recovery
 		PermessageDeflate: gws.PermessageDeflate{Enabled: true}, // Enable compression
 	})
-	http.HandleFunc("/sender", func(writer http.ResponseWriter, request *http.Request) {
+	http.HandleFunc(cfg.SenderPath, func(writer http.ResponseWriter, request *http.Request) {
+		// Added before the upgrade, which hides the connection from
+		// srv.Shutdown.
+		handler.conns.Add(1)
+
 		socket, err := upgrader.Upgrade(writer, request)
 		if err != nil {
+			handler.conns.Done()
 			return
 		}
 		go func() {
+			defer handler.conns.Done()
 			socket.ReadLoop() // Blocking prevents the context from being GC.
 		}()
 	})
 
-	http.ListenAndServe(":8080", nil)
+	serverTLS, err := tlsconf.Server(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{Addr: cfg.SenderListen, TLSConfig: serverTLS}
+	go func() {
+		var err error
+		if serverTLS != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("shutting down")
+
+	// Stop accepting relays, then give the connected ones until the
+	// deadline to drain their messages.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	_ = srv.Shutdown(shutdownCtx)
+
+	drained := make(chan struct{})
+	go func() {
+		handler.conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		log.Println("shutdown: connections still open")
+	}
 }
 
-type Handler struct{}
+type Handler struct {
+	cfg   *conf.Config
+	clk   *clock.Clock
+	rtt   *echo.Tracker // nil without echoes
+	conns sync.WaitGroup
+
+	// Shared by every relay, so that a reconnecting relay continues the
+	// sequence rather than restarting it.
+	messageChan chan []byte
+
+	connected   chan struct{} // closed when the first relay sends ready
+	connectOnce sync.Once
+}
+
+// Create messages until shutdown, then close messageChan so the relays
+// drain it.
+func (c *Handler) generate(ctx context.Context, replay []capture.Record) {
+	defer close(c.messageChan)
+
+	payloads := payload.FromConfig(c.cfg, replay)
+
+	pace := pacer.New(c.cfg, replay)
+	sequencer := envelope.NewSequencer(uint32(c.cfg.SenderID), c.cfg.TopicList())
+
+	// The schedule starts with the first relay; before it, messages would
+	// queue up in messageChan and their wait count as latency.
+	if pace != nil {
+		select {
+		case <-c.connected:
+		case <-ctx.Done():
+			return
+		}
+	}
+
+	for {
+		if c.cfg.Throttled() {
+			time.Sleep(c.cfg.SenderThrottle())
+		}
+
+		byteArray := payloads.Next()
+
+		h := sequencer.Next()
+		if pace != nil {
+			at, ok := pace.Wait(ctx)
+			if !ok {
+				return
+			}
+			h.IntendedTime = c.clk.At(at)
+		}
+		msg := envelope.Encode(
+			make([]byte, 0, envelope.Size(h.Topic, len(byteArray))),
+			h,
+			byteArray,
+		)
+
+		select {
+		case c.messageChan <- msg:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
 func (c *Handler) OnOpen(socket *gws.Conn) {
+	connections.Inc()
+	socket.Session().Store(closedKey, make(chan struct{}))
 	//_ = socket.SetDeadline(time.Now().Add(PingInterval + PingWait))
 }
 
-func (c *Handler) OnClose(socket *gws.Conn, err error) {}
+func (c *Handler) OnClose(socket *gws.Conn, err error) {
+	connections.Dec()
+	if closed, ok := socket.Session().Load(closedKey); ok {
+		close(closed.(chan struct{}))
+	}
+}
 
 func (c *Handler) OnPing(socket *gws.Conn, payload []byte) {
 	_ = socket.SetDeadline(time.Now().Add(PingInterval + PingWait))
@@ -51,57 +219,52 @@ func (c *Handler) OnPong(socket *gws.Conn, payload []byte) {}
 
 func (c *Handler) OnMessage(socket *gws.Conn, message *gws.Message) {
 	defer message.Close()
-	
-	
+
 	if message.Data.String() == "ready" {
 		fmt.Println("Client sent ready")
-		
-		loopBroadcast(socket)
+
+		c.loopBroadcast(socket)
 	}
 }
 
-func loopBroadcast(socket *gws.Conn) {
-	messageChan := make(chan []byte, conf.MessageChanSize)
+func (c *Handler) loopBroadcast(socket *gws.Conn) {
+	c.connectOnce.Do(func() { close(c.connected) })
 
-	// Create messages
-	go func() {
-		prng := rand.New(rand.NewSource(conf.RandSeed))
+	// Closed by OnClose, so a dead relay stops taking from messageChan
+	// while it is idle.
+	v, _ := socket.Session().Load(closedKey)
+	closed := v.(chan struct{})
 
-		for {
-			if conf.SenderThrottleMillis > 0 {
-				time.Sleep(conf.SenderThrottleMillis * time.Millisecond)
-			}
-
-			
-			randomLength := prng.Intn(conf.PayloadMaxBytes-conf.PayloadMinBytes) + conf.PayloadMinBytes
-			byteArray := make([]byte, 8+randomLength)
-			_, err := prng.Read(byteArray[8:])
-			if err != nil {
-				panic(err)
-			}
-
-			select {
-			case messageChan <- byteArray:
+	for {
+		// Waits for the generator when it is behind, e.g. replaying as
+		// fast as possible.
+		var msgBytes []byte
+		select {
+		case <-closed:
+			return
+		case msg, ok := <-c.messageChan:
+			if !ok {
+				// Sends a close frame and closes the connection.
+				_ = socket.WriteClose(1000, nil)
+				return
 			}
+			msgBytes = msg
 		}
-	}()
 
-	time.Sleep(100 * time.Millisecond)
-
-	for {
-		if len(messageChan) == 0 {
-			panic("message chan is empty")
+		envelope.SetSendTime(msgBytes, c.clk.Now())
+		if c.rtt != nil {
+			c.rtt.Sent(msgBytes)
 		}
 
-		msgBytes := <-messageChan
-
-		timestamp := time.Now().UnixNano()
-		binary.LittleEndian.PutUint64(msgBytes[:8], uint64(timestamp))
-
-		socket.WriteMessage(gws.OpcodeBinary, msgBytes)
+		// A failed write means the relay is gone; messageChan is left to
+		// the relays that are still connected.
+		if err := socket.WriteMessage(gws.OpcodeBinary, msgBytes); err != nil {
+			return
+		}
+		sentTotal.Inc()
 
-		if conf.SenderThrottleMillis > 0 {
-			time.Sleep(conf.SenderThrottleMillis * time.Millisecond)
+		if c.cfg.Throttled() {
+			time.Sleep(c.cfg.SenderThrottle())
 		}
 	}
 }
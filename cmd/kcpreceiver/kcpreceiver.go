@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"go-relay/cmd/conf"
+	"go-relay/kcpconn"
+	"go-relay/metrics"
+	"go-relay/relay"
+	"go-relay/stats"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
+
+	collector, err := stats.NewCollector(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	conn, err := kcpconn.Dial(cfg.RelayAddr, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(sigCtx)
+
+	if err := conn.WriteMessage([]byte("ready")); err != nil {
+		log.Fatal(err)
+	}
+	if topics := cfg.TopicList(); topics != nil {
+		if err := conn.WriteMessage(relay.SubscribeMessage(topics)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	go func() {
+		defer cancel()
+
+		for {
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				log.Println(err)
+				break
+			}
+
+			collector.Offer(msg, time.Now().UnixNano())
+		}
+	}()
+
+	collector.Run(ctx)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"go-relay/clock"
+	"go-relay/cmd/conf"
+	"go-relay/metrics"
+	"go-relay/relay"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
+
+	// Hop timestamps are read off the system clock.
+	if cfg.RelayClockListen != "" {
+		go func() {
+			log.Fatal(clock.Serve(cfg.RelayClockListen, new(clock.Clock)))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var ups []relay.Upstream
+	for _, addr := range cfg.SenderAddrs() {
+		ups = append(ups, relay.NewKCPUpstream(addr, cfg))
+	}
+
+	r := relay.New(cfg, ups,
+		relay.NewKCPDownstream(cfg.RelayListen, cfg),
+	)
+	if err := r.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		if err := r.Shutdown(shutdownCtx); err != nil {
+			log.Println("shutdown:", err)
+		}
+		cancel()
+	case <-r.Done():
+	}
+
+	r.Wait()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"go-relay/capture"
+	"go-relay/clock"
+	"go-relay/cmd/conf"
+	"go-relay/echo"
+	"go-relay/envelope"
+	"go-relay/kcpconn"
+	"go-relay/metrics"
+	"go-relay/pacer"
+	"go-relay/payload"
+	"log"
+	"os"
+	"os/signal"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	sentTotal   = metrics.NewCounter("sender_messages_sent_total", "Messages written to relays.")
+	connections = metrics.NewGauge("sender_connections", "Connected relays.")
+)
+
+func main() {
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
+
+	replay, err := capture.LoadReplay(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clk := clock.FromConfig(cfg)
+	if cfg.ClockListen != "" {
+		go func() {
+			log.Fatal(clock.Serve(cfg.ClockListen, clk))
+		}()
+	}
+
+	var rtt *echo.Tracker
+	if cfg.EchoListen != "" {
+		rtt = echo.NewTracker(cfg.EchoWindow)
+		go func() {
+			log.Fatal(rtt.Serve(cfg.EchoListen))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	messageChan := make(chan []byte, cfg.MessageChanSize)
+
+	// Closed when the first relay sends ready.
+	connected := make(chan struct{})
+	var connectOnce sync.Once
+
+	// Create messages until shutdown, then close messageChan so the
+	// connections drain it.
+	go func() {
+		defer close(messageChan)
+
+		payloads := payload.FromConfig(cfg, replay)
+
+		pace := pacer.New(cfg, replay)
+		sequencer := envelope.NewSequencer(uint32(cfg.SenderID), cfg.TopicList())
+
+		// The schedule starts with the first relay; before it, messages
+		// would queue up in messageChan and their wait count as latency.
+		if pace != nil {
+			select {
+			case <-connected:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		for {
+			if cfg.Throttled() {
+				time.Sleep(cfg.SenderThrottle())
+			}
+
+			data := payloads.Next()
+
+			h := sequencer.Next()
+			if pace != nil {
+				at, ok := pace.Wait(ctx)
+				if !ok {
+					return
+				}
+				h.IntendedTime = clk.At(at)
+			}
+			msg := envelope.Encode(
+				make([]byte, 0, envelope.Size(h.Topic, len(data))),
+				h,
+				data,
+			)
+
+			select {
+			case messageChan <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	l, err := kcpconn.Listen(cfg.SenderListen, cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var conns sync.WaitGroup
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Fatal(err)
+			}
+
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				defer conn.Close()
+
+				if cfg.LockOSThread {
+					runtime.LockOSThread()
+					defer runtime.UnlockOSThread()
+				}
+
+				// Wait for ready
+				if _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+				log.Println("Client sent ready:", conn.RemoteAddr())
+
+				connections.Inc()
+				defer connections.Dec()
+				connectOnce.Do(func() { close(connected) })
+
+				for msg := range messageChan {
+					// Stamp and send message
+					envelope.SetSendTime(msg, clk.Now())
+					if rtt != nil {
+						rtt.Sent(msg)
+					}
+					if err := conn.WriteMessage(msg); err != nil {
+						log.Println(err)
+						return
+					}
+					sentTotal.Inc()
+				}
+			}()
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("shutting down")
+
+	// KCP has no close frames; the connections end once they drained
+	// messageChan. The sessions share the listener's socket, so it is
+	// closed last.
+	drained := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(cfg.ShutdownTimeout):
+		log.Println("shutdown: connections still open")
+	}
+	_ = l.Close()
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"go-relay/cmd/conf"
+	"go-relay/metrics"
+	"go-relay/relay"
+	"go-relay/stats"
+	"go-relay/tlsconf"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const readBufferSize = 64 * 1024
+
+func main() {
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
+
+	collector, err := stats.NewCollector(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Plain connections are read with epoll; TLS is decrypted in userspace,
+	// so its connection is read through the runtime instead.
+	var (
+		conn io.ReadWriter
+		loop func() error
+	)
+	if cfg.TLS {
+		tc, pending, err := dialTLS(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer tc.Close()
+		collector.SetTLS(tc.ConnectionState())
+
+		conn = tc
+		loop = func() error { return streamLoop(tc, pending, collector) }
+	} else {
+		fd, pending, err := dial(cfg.RelayAddr, cfg.RelayPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer unix.Close(fd)
+
+		conn = socket(fd)
+		loop = func() error { return readLoop(cfg, fd, pending, collector) }
+	}
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(sigCtx)
+
+	if err := writeFrame(conn, opText, []byte("ready")); err != nil {
+		log.Fatal(err)
+	}
+	if topics := cfg.TopicList(); topics != nil {
+		if err := writeFrame(conn, opText, relay.SubscribeMessage(topics)); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	read := make(chan struct{})
+	go func() {
+		defer close(read)
+		defer cancel()
+
+		if err := loop(); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	collector.Run(ctx)
+
+	// Close normally (1000); reading ends with the relay's reply.
+	if err := writeFrame(conn, opClose, []byte{0x03, 0xe8}); err == nil {
+		select {
+		case <-read:
+		case <-time.After(cfg.ShutdownTimeout):
+			log.Println("shutdown: relay did not close the connection")
+		}
+	}
+}
+
+// dial opens a blocking TCP connection and upgrades it to a websocket,
+// returning the socket in non-blocking mode.
+func dial(hostport, path string) (int, []byte, error) {
+	addr, err := net.ResolveTCPAddr("tcp4", hostport)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP)
+	if err != nil {
+		return -1, nil, err
+	}
+
+	sa := &unix.SockaddrInet4{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To4())
+
+	if err := unix.Connect(fd, sa); err != nil {
+		unix.Close(fd)
+		return -1, nil, fmt.Errorf("connect %v: %w", addr, err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); err != nil {
+		unix.Close(fd)
+		return -1, nil, err
+	}
+
+	pending, err := handshake(socket(fd), addr.String(), path)
+	if err != nil {
+		unix.Close(fd)
+		return -1, nil, err
+	}
+
+	if err := unix.SetNonblock(fd, true); err != nil {
+		unix.Close(fd)
+		return -1, nil, err
+	}
+
+	return fd, pending, nil
+}
+
+// readLoop waits for the socket with epoll, drains it and hands every
+// complete message to the collector, stamped with the time of the read.
+func readLoop(cfg *conf.Config, fd int, pending []byte, collector *stats.Collector) error {
+	if cfg.LockOSThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(epfd)
+
+	event := unix.EpollEvent{Events: unix.EPOLLIN | unix.EPOLLRDHUP, Fd: int32(fd)}
+	if err := unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, fd, &event); err != nil {
+		return err
+	}
+
+	base := make([]byte, readBufferSize)
+	buf := append(base[:0], pending...)
+	events := make([]unix.EpollEvent, 1)
+
+	var (
+		message []byte // fragments of a message split across frames
+		closed  bool
+	)
+
+	recvNanoTS := time.Now().UnixNano()
+	for {
+		// Frames that arrived with the handshake response are parsed on
+		// the first pass, before waiting.
+		var done bool
+		buf, done, err = consume(socket(fd), buf, &message, collector, recvNanoTS)
+		if err != nil || done {
+			return err
+		}
+
+		if closed {
+			return errors.New("relay closed the connection")
+		}
+
+		// Move a partial frame to the front so reads can append to it.
+		buf = append(base[:0], buf...)
+
+		if _, err := unix.EpollWait(epfd, events, -1); err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			return err
+		}
+
+		closed, err = readAvailable(fd, &buf)
+		if err != nil {
+			return err
+		}
+		recvNanoTS = time.Now().UnixNano()
+	}
+}
+
+// streamLoop is readLoop for a TLS connection.
+func streamLoop(conn *tls.Conn, pending []byte, collector *stats.Collector) error {
+	base := make([]byte, readBufferSize)
+	buf := append(base[:0], pending...)
+
+	var message []byte
+	recvNanoTS := time.Now().UnixNano()
+	for {
+		var (
+			done bool
+			err  error
+		)
+		buf, done, err = consume(conn, buf, &message, collector, recvNanoTS)
+		if err != nil || done {
+			return err
+		}
+
+		buf = append(base[:0], buf...)
+		if len(buf) == cap(buf) {
+			buf = append(buf, make([]byte, readBufferSize)...)[:len(buf)]
+		}
+		base = buf[:0]
+
+		n, err := conn.Read(buf[len(buf):cap(buf)])
+		if err == io.EOF {
+			return errors.New("relay closed the connection")
+		}
+		if err != nil {
+			return err
+		}
+		buf = buf[:len(buf)+n]
+		recvNanoTS = time.Now().UnixNano()
+	}
+}
+
+// consume hands the complete messages at the front of buf to the collector
+// and returns the rest, answering pings and a close, after which it
+// reports done.
+func consume(w io.Writer, buf []byte, message *[]byte, collector *stats.Collector, recvNanoTS int64) ([]byte, bool, error) {
+	for len(buf) > 0 {
+		f, n, err := parseFrame(buf)
+		if err != nil {
+			return nil, false, err
+		}
+		if n == 0 {
+			break
+		}
+
+		switch f.opcode {
+		case opText, opBinary, opContinuation:
+			*message = append(*message, f.payload...)
+			if f.fin {
+				collector.Offer(*message, recvNanoTS)
+				*message = nil
+			}
+		case opPing:
+			if err := writeFrame(w, opPong, f.payload); err != nil {
+				return nil, false, err
+			}
+		case opClose:
+			_ = writeFrame(w, opClose, f.payload)
+			return nil, true, nil
+		}
+
+		buf = buf[n:]
+	}
+	return buf, false, nil
+}
+
+// dialTLS is dial over TLS, on a blocking crypto/tls connection.
+func dialTLS(cfg *conf.Config) (*tls.Conn, []byte, error) {
+	config, err := tlsconf.Client(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := tls.Dial("tcp", cfg.RelayAddr, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	pending, err := handshake(conn, cfg.RelayAddr, cfg.RelayPath)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, pending, nil
+}
+
+// readAvailable appends everything readable on the non-blocking socket to buf.
+func readAvailable(fd int, buf *[]byte) (closed bool, err error) {
+	for {
+		b := *buf
+		if len(b) == cap(b) {
+			b = append(b, make([]byte, readBufferSize)...)[:len(b)]
+		}
+
+		n, err := unix.Read(fd, b[len(b):cap(b)])
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err == unix.EAGAIN:
+			return false, nil
+		case err != nil:
+			return false, err
+		case n == 0:
+			return true, nil
+		}
+
+		*buf = b[:len(b)+n]
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// handshake performs the client side of the websocket upgrade on a blocking
+// connection. Bytes read past the response headers are returned, since the
+// server may send frames right after it.
+func handshake(conn io.ReadWriter, host, path string) ([]byte, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	req := "GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + host + "\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\n" +
+		"Sec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		return nil, err
+	}
+
+	var resp []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err == io.EOF {
+			return nil, errors.New("connection closed during handshake")
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp = append(resp, buf[:n]...)
+
+		end := bytes.Index(resp, []byte("\r\n\r\n"))
+		if end < 0 {
+			continue
+		}
+
+		header, rest := resp[:end], resp[end+4:]
+		if !bytes.HasPrefix(header, []byte("HTTP/1.1 101")) {
+			line, _, _ := bytes.Cut(header, []byte("\r\n"))
+			return nil, fmt.Errorf("upgrade refused: %s", line)
+		}
+
+		sum := sha1.Sum([]byte(key + websocketGUID))
+		accept := base64.StdEncoding.EncodeToString(sum[:])
+		if !bytes.Contains(header, []byte(accept)) {
+			return nil, errors.New("bad Sec-WebSocket-Accept")
+		}
+
+		return rest, nil
+	}
+}
+
+// frame is a websocket frame parsed in place from a read buffer.
+type frame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// parseFrame parses the first frame of b, reporting how many bytes it
+// used, or 0 if b does not hold a whole frame yet.
+func parseFrame(b []byte) (frame, int, error) {
+	var f frame
+
+	if len(b) < 2 {
+		return f, 0, nil
+	}
+	f.fin = b[0]&0x80 != 0
+	f.opcode = b[0] & 0x0f
+	masked := b[1]&0x80 != 0
+
+	length := uint64(b[1] & 0x7f)
+	offset := 2
+	switch length {
+	case 126:
+		if len(b) < 4 {
+			return f, 0, nil
+		}
+		length = uint64(binary.BigEndian.Uint16(b[2:]))
+		offset = 4
+	case 127:
+		if len(b) < 10 {
+			return f, 0, nil
+		}
+		length = binary.BigEndian.Uint64(b[2:])
+		offset = 10
+	}
+	if length > 1<<31 {
+		return f, 0, fmt.Errorf("frame too large: %d bytes", length)
+	}
+
+	var mask []byte
+	if masked {
+		if len(b) < offset+4 {
+			return f, 0, nil
+		}
+		mask = b[offset : offset+4]
+		offset += 4
+	}
+
+	end := offset + int(length)
+	if len(b) < end {
+		return f, 0, nil
+	}
+
+	f.payload = b[offset:end]
+	if mask != nil {
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+
+	return f, end, nil
+}
+
+// writeFrame sends a single masked client frame.
+func writeFrame(w io.Writer, opcode byte, payload []byte) error {
+	buf := make([]byte, 0, 14+len(payload))
+	buf = append(buf, 0x80|opcode)
+
+	switch n := len(payload); {
+	case n < 126:
+		buf = append(buf, 0x80|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, 0x80|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, 0x80|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	buf = append(buf, mask[:]...)
+	for i, c := range payload {
+		buf = append(buf, c^mask[i%4])
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// socket reads and writes a TCP socket with plain syscalls.
+type socket int
+
+func (fd socket) Read(b []byte) (int, error) {
+	for {
+		n, err := unix.Read(int(fd), b)
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err != nil:
+			return 0, err
+		case n == 0:
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+}
+
+func (fd socket) Write(b []byte) (int, error) {
+	if err := writeAll(int(fd), b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func writeAll(fd int, b []byte) error {
+	for len(b) > 0 {
+		n, err := unix.Write(fd, b)
+		switch err {
+		case nil:
+			b = b[n:]
+		case unix.EINTR:
+		case unix.EAGAIN:
+			// The socket buffer is full; control frames are rare and
+			// small, so wait for it to drain.
+			fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+			if _, err := unix.Poll(fds, -1); err != nil && err != unix.EINTR {
+				return err
+			}
+		default:
+			return err
+		}
+	}
+	return nil
+}
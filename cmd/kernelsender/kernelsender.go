@@ -1,15 +1,23 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"flag"
+	"go-relay/capture"
+	"go-relay/clock"
 	"go-relay/cmd/conf"
+	"go-relay/echo"
+	"go-relay/envelope"
+	"go-relay/metrics"
+	"go-relay/pacer"
+	"go-relay/payload"
+	"go-relay/tlsconf"
 	"log"
-	"math/rand"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/Allenxuxu/gev"
@@ -23,9 +31,23 @@ var (
 	keyUri           = "uri"
 )
 
+var (
+	sentTotal   = metrics.NewCounter("sender_messages_sent_total", "Messages written to relays.")
+	connections = metrics.NewGauge("sender_connections", "Connected relays.")
+)
+
 type example struct {
 	sync.Mutex
+	cfg      *conf.Config
+	replay   []capture.Record
+	clk      *clock.Clock
+	rtt      *echo.Tracker   // nil without echoes
+	ctx      context.Context // done on shutdown
+	front    *tlsconf.Front  // nil without TLS
 	sessions map[*gev.Connection]*Session
+
+	connected   chan struct{} // closed when the first relay sends ready
+	connectOnce sync.Once
 }
 
 type Session struct {
@@ -40,23 +62,34 @@ type Session struct {
 func (s *example) OnConnect(c *gev.Connection) {
 	log.Println("OnConnect: ", c.PeerAddr())
 
-	s.Lock()
-	defer s.Unlock()
-
-	s.sessions[c] = &Session{
-		first: true,
-		conn:  c,
+	// Relays are no longer accepted while shutting down, nor past the TLS
+	// front.
+	if s.ctx.Err() != nil || (s.front != nil && !s.front.Forwarded(c.PeerAddr())) {
+		_ = c.Close()
 	}
 }
 
+// OnMessage adds a relay to the sessions on its "ready": OnConnect fires
+// before the websocket upgrade, when broadcast frames would corrupt the
+// handshake response, and for bare TCP probes.
 func (s *example) OnMessage(c *gev.Connection, data []byte) (messageType ws.MessageType, out []byte) {
 	log.Println("OnMessage: ", string(data))
 
 	s.Lock()
 	session, ok := s.sessions[c]
 	if !ok {
-		s.Unlock()
-		return
+		if s.ctx.Err() != nil {
+			s.Unlock()
+			_ = c.Close()
+			return
+		}
+		session = &Session{
+			first: true,
+			conn:  c,
+		}
+		s.sessions[c] = session
+		connections.Set(int64(len(s.sessions)))
+		s.connectOnce.Do(func() { close(s.connected) })
 	}
 	s.Unlock()
 
@@ -90,66 +123,134 @@ func (s *example) OnClose(c *gev.Connection) {
 	defer s.Unlock()
 
 	delete(s.sessions, c)
+	connections.Set(int64(len(s.sessions)))
 }
 
+// closeSessions sends every relay a close frame and closes its connection
+// once the frame was written, or at deadline.
+func (s *example) closeSessions(deadline time.Time) {
+	frame, err := util.PackCloseData("")
+	if err != nil {
+		return
+	}
+
+	s.Lock()
+	conns := make([]*gev.Connection, 0, len(s.sessions))
+	for c := range s.sessions {
+		conns = append(conns, c)
+	}
+	s.Unlock()
+
+	for _, c := range conns {
+		_ = c.Send(frame)
+	}
+	for _, c := range conns {
+		for c.WriteBufferLength() > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		_ = c.Close()
+	}
+}
+
+// loopBroadcast sends messages to the sessions in turn until shutdown, then
+// until the messages already created are sent.
 func loopBroadcast(serv *example) {
-	messageChan := make(chan []byte, conf.MessageChanSize)
+	cfg := serv.cfg
+	ctx := serv.ctx
+	messageChan := make(chan []byte, cfg.MessageChanSize)
 
 	// Create messages
 	go func() {
-		prng := rand.New(rand.NewSource(conf.RandSeed))
+		defer close(messageChan)
+
+		payloads := payload.FromConfig(cfg, serv.replay)
+
+		pace := pacer.New(cfg, serv.replay)
+		sequencer := envelope.NewSequencer(uint32(cfg.SenderID), cfg.TopicList())
+
+		// The schedule starts with the first relay; before it, messages
+		// would queue up in messageChan and their wait count as latency.
+		if pace != nil {
+			select {
+			case <-serv.connected:
+			case <-ctx.Done():
+				return
+			}
+		}
 
 		for {
-			if conf.SenderThrottleMillis > 0 {
-				time.Sleep(conf.SenderThrottleMillis * time.Millisecond)
+			if cfg.Throttled() {
+				time.Sleep(cfg.SenderThrottle())
 			}
 
-			//// Generate random payload (2-4096 bytes)
-			length := prng.Intn(conf.PayloadMaxBytes-conf.PayloadMinBytes) + conf.PayloadMinBytes
-			data := make([]byte, length)
-			prng.Read(data)
+			data := payloads.Next()
+
+			h := sequencer.Next()
+			if pace != nil {
+				at, ok := pace.Wait(ctx)
+				if !ok {
+					return
+				}
+				h.IntendedTime = serv.clk.At(at)
+			}
+			msg := envelope.Encode(
+				make([]byte, 0, envelope.Size(h.Topic, len(data))),
+				h,
+				data,
+			)
 
 			select {
-			case messageChan <- data:
+			case messageChan <- msg:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
-	
-	time.Sleep(100 * time.Millisecond)
 
+	var sessions []*Session
 	for {
-		//serv.Lock()
-
+		// OnConnect and OnClose edit serv.sessions from the gev loops, so
+		// send from a copy taken under the lock.
+		serv.Lock()
+		sessions = sessions[:0]
 		for _, session := range serv.sessions {
+			sessions = append(sessions, session)
+		}
+		serv.Unlock()
+
+		// Without sessions there is nobody to drain messageChan for.
+		if ctx.Err() != nil && len(sessions) == 0 {
+			return
+		}
+
+		for _, session := range sessions {
 			if session == nil {
 				continue
 			}
 
-			if len(messageChan) == 0 {
-				panic("message chan is empty")
+			// Waits for the generator when it is behind, e.g. replaying
+			// as fast as possible.
+			msgBytes, ok := <-messageChan
+			if !ok {
+				return
 			}
 
-			msgBytes := <-messageChan
-
-			buf := bytes.NewBuffer(make([]byte, 0, conf.TimestampBytes+len(msgBytes)))
-
-			// Prepend timestamp (int64, 8 bytes)
-			binary.Write(buf, binary.BigEndian, time.Now().UnixNano())
-			buf.Write(msgBytes)
-
-			payloadBytes := buf.Bytes()
+			envelope.SetSendTime(msgBytes, serv.clk.Now())
+			if serv.rtt != nil {
+				serv.rtt.Sent(msgBytes)
+			}
 
-			msg, err := util.PackData(ws.MessageBinary, payloadBytes)
+			msg, err := util.PackData(ws.MessageBinary, msgBytes)
 			if err != nil {
 				continue
 			}
-			_ = session.conn.Send(msg)
+			if session.conn.Send(msg) == nil {
+				sentTotal.Inc()
+			}
 		}
 
-		//serv.Unlock()
-
-		if conf.SenderThrottleMillis > 0 {
-			time.Sleep(conf.SenderThrottleMillis * time.Millisecond)
+		if cfg.Throttled() {
+			time.Sleep(cfg.SenderThrottle())
 		}
 	}
 }
@@ -161,17 +262,47 @@ func NewWebSocketServer(handler websocket.WSHandler, u *ws.Upgrader, opts ...gev
 }
 
 func main() {
-	var (
-		port  int
-		loops int
-	)
+	var loops int
 
-	flag.IntVar(&port, "port", 8080, "server port")
 	flag.IntVar(&loops, "loops", -1, "num loops")
-	flag.Parse()
+
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
+
+	replay, err := capture.LoadReplay(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clk := clock.FromConfig(cfg)
+	if cfg.ClockListen != "" {
+		go func() {
+			log.Fatal(clock.Serve(cfg.ClockListen, clk))
+		}()
+	}
+
+	var rtt *echo.Tracker
+	if cfg.EchoListen != "" {
+		rtt = echo.NewTracker(cfg.EchoWindow)
+		go func() {
+			log.Fatal(rtt.Serve(cfg.EchoListen))
+		}()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	handler := &example{
-		sessions: make(map[*gev.Connection]*Session, 10),
+		cfg:       cfg,
+		replay:    replay,
+		clk:       clk,
+		rtt:       rtt,
+		ctx:       ctx,
+		sessions:  make(map[*gev.Connection]*Session, 10),
+		connected: make(chan struct{}),
 	}
 
 	wsUpgrader := &ws.Upgrader{}
@@ -198,18 +329,50 @@ func main() {
 		return nil
 	}
 
-	go loopBroadcast(handler)
+	broadcastDone := make(chan struct{})
+	go func() {
+		defer close(broadcastDone)
+		loopBroadcast(handler)
+	}()
 
-	s, err := NewWebSocketServer(
-		handler,
-		wsUpgrader,
+	opts := []gev.Option{
 		gev.Network("tcp"),
-		gev.Address(":"+strconv.Itoa(port)),
+		gev.Address(cfg.SenderListen),
 		gev.NumLoops(loops),
-	)
+	}
+
+	// gev cannot speak TLS, so a front terminates it and the loops serve
+	// the loopback address it reserved, to the front alone.
+	serverTLS, err := tlsconf.Server(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if serverTLS != nil {
+		front, err := tlsconf.Listen(cfg.SenderListen, serverTLS)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer front.Close()
+		handler.front = front
+		opts = append(opts, gev.Address(front.Backend))
+	}
+
+	s, err := NewWebSocketServer(handler, wsUpgrader, opts...)
 	if err != nil {
 		panic(err)
 	}
 
-	s.Start()
+	go s.Start()
+
+	<-ctx.Done()
+	log.Println("shutting down")
+
+	deadline := time.Now().Add(cfg.ShutdownTimeout)
+	select {
+	case <-broadcastDone:
+	case <-time.After(cfg.ShutdownTimeout):
+		log.Println("shutdown: messages left undelivered")
+	}
+	handler.closeSessions(deadline)
+	s.Stop()
 }
@@ -1,128 +1,105 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
-	"fmt"
+	"context"
+	"crypto/tls"
 	"github.com/gorilla/websocket"
 	"go-relay/cmd/conf"
-	"runtime"
+	"go-relay/metrics"
+	"go-relay/relay"
+	"go-relay/stats"
+	"go-relay/tlsconf"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 )
 
-type MessageLatency struct {
-	msg        []byte
-	recvNanoTS int64
-}
-
 func main() {
-	//dialer := websocket.Dialer{
-	//	ReadBufferSize:  conf.ReadBufferSize,
-	//	WriteBufferSize: conf.WriteBufferSize,
-	//}
-
-	ws, _, _ := websocket.DefaultDialer.Dial("ws://localhost:8080/sender", nil)
-	defer func() {
-		if ws != nil {
-			ws.Close()
-		}
-	}()
-
-	messageChan := make(chan MessageLatency, conf.MessageChanSize)
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
 
-	go func() {
-		if conf.LockOSThread {
-			runtime.LockOSThread()
-			defer runtime.UnlockOSThread()
-		}
+	collector, err := stats.NewCollector(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		var (
-			minLatency  = time.Duration(1<<63 - 1)
-			maxLatency  time.Duration
-			total       time.Duration
-			lastLatency time.Duration
-			count       int
-		)
+	//dialer := websocket.Dialer{
+	//	ReadBufferSize:  cfg.ReadBufferSize,
+	//	WriteBufferSize: cfg.WriteBufferSize,
+	//}
 
-		ticker := time.NewTicker(time.Second)
-		defer ticker.Stop()
+	clientTLS, err := tlsconf.Client(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = clientTLS
+
+	sigCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithCancel(sigCtx)
+	defer cancel()
+
+	// Every connection is a separate subscriber of the relay. They are
+	// dialed while the collector runs, so early messages are not dropped.
+	var conns sync.WaitGroup
+	for i := range cfg.Subscribers {
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			defer cancel()
+
+			ws, _, err := dialer.Dial(cfg.RelayURL(), nil)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			defer ws.Close()
+			if tc, ok := ws.NetConn().(*tls.Conn); ok {
+				collector.SetTLS(tc.ConnectionState())
+			}
 
-		for {
-			select {
-			case <-ticker.C:
-				nowTimeStr := time.Now().Format(time.DateTime)
-				if count < conf.IgnoreInitialMessageCount {
-					fmt.Printf(
-						"%v: Ignoring initial messages, count=%v/%v\n",
-						nowTimeStr,
-						count,
-						conf.IgnoreInitialMessageCount,
-					)
-					continue
-				}
+			// Once the run ends, ask the relay to close the connection;
+			// reading ends with its reply.
+			stopClose := context.AfterFunc(ctx, func() {
+				msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+				_ = ws.WriteControl(websocket.CloseMessage, msg, time.Now().Add(cfg.ShutdownTimeout))
+			})
+			defer stopClose()
+
+			ws.WriteMessage(websocket.BinaryMessage, []byte("ready"))
+			if topics := cfg.TopicList(); topics != nil {
+				ws.WriteMessage(websocket.TextMessage, relay.SubscribeMessage(topics))
+			}
 
-				fmt.Printf(
-					"%v:  SampleLatency: %v | Min: %v | Max: %v | Avg: %v | Count: %v| UseGosched: %v\n",
-					nowTimeStr,
-					lastLatency,
-					minLatency,
-					maxLatency,
-					total/time.Duration(count),
-					count,
-					conf.UseGosched,
-				)
-			case ml := <-messageChan:
-				count++
-				if count < conf.IgnoreInitialMessageCount {
-					continue
+			for {
+				_, msg, err := ws.ReadMessage()
+				if err != nil {
+					break
 				}
 
-				msg := ml.msg
-				// Extract timestamp (first 8 bytes)
-				var ts int64
-				binary.Read(bytes.NewReader(msg[:conf.TimestampBytes]), binary.BigEndian, &ts)
-				latency := time.Duration(ml.recvNanoTS - ts)
-
-				// Update metrics
-				if latency < minLatency {
-					minLatency = latency
-				}
-				if latency > maxLatency {
-					maxLatency = latency
-				}
-				total += latency
-				lastLatency = latency
-			default:
-				if conf.UseGosched {
-					runtime.Gosched()
-				}
+				collector.OfferFrom(i, msg, time.Now().UnixNano())
 			}
-		}
-	}()
-	
-	ws.WriteMessage(websocket.BinaryMessage, []byte("ready"))
-
-	for {
-		_, msg, err := ws.ReadMessage()
-		if err != nil {
-			break
-		}
-		if err != nil || len(msg) < 8 {
-			continue
-		}
-
-		recvNanoTS := time.Now().UnixNano()
-
-		ml := MessageLatency{
-			msg:        msg,
-			recvNanoTS: recvNanoTS,
-		}
+		}()
+	}
 
-		select {
-		case messageChan <- ml:
-		default:
-			fmt.Println("receiver chan full")
-		}
+	collector.Run(ctx)
+	cancel()
 
+	closed := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(cfg.ShutdownTimeout):
+		log.Println("shutdown: connections still open")
 	}
 }
@@ -1,71 +1,73 @@
 package main
 
 import (
-	"fmt"
-	"github.com/gorilla/websocket"
+	"context"
+	"go-relay/clock"
 	"go-relay/cmd/conf"
-	"net/http"
-	"runtime"
-)
-
-var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  conf.ReadBufferSize,
-		WriteBufferSize: conf.WriteBufferSize,
-	}
+	"go-relay/metrics"
+	"go-relay/relay"
+	"go-relay/tlsconf"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	// Connect to Source
-	senderWS, _, _ := websocket.DefaultDialer.Dial("ws://localhost:8080/sender", nil)
-	defer senderWS.Close()
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
 
-	var receiverWS *websocket.Conn
+	// Hop timestamps are read off the system clock.
+	if cfg.RelayClockListen != "" {
+		go func() {
+			log.Fatal(clock.Serve(cfg.RelayClockListen, new(clock.Clock)))
+		}()
+	}
 
-	messageChan := make(chan []byte, conf.MessageChanSize)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// Forward messages from Source to Dest
-	go func() {
-		if conf.LockOSThread {
-			runtime.LockOSThread()
-			defer runtime.UnlockOSThread()
-		}
+	// Connect to Sources
+	clientTLS, err := tlsconf.Client(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	serverTLS, err := tlsconf.Server(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		for {
-			select {
-			case msg := <-messageChan:
-				if receiverWS == nil {
-					continue
-				}
-				
-				receiverWS.WriteMessage(websocket.BinaryMessage, msg)
-			default:
-				if conf.UseGosched {
-					runtime.Gosched()
-				}
-			}
-		}
-	}()
+	var ups []relay.Upstream
+	for _, url := range cfg.SenderURLs() {
+		u := relay.NewGorillaUpstream(url)
+		u.TLSConfig = clientTLS
+		ups = append(ups, u)
+	}
 
 	// Accept Dest connections
-	http.HandleFunc("/relay", func(w http.ResponseWriter, r *http.Request) {
-		receiverWS, _ = upgrader.Upgrade(w, r, nil)
-		defer receiverWS.Close()
-
-		// Read message, add to channel
-		for {
-			_, msg, err := senderWS.ReadMessage()
-			if err != nil {
-				break
-			}
+	down := relay.NewGorillaDownstream(cfg.RelayListen, cfg.RelayPath)
+	down.Upgrader.ReadBufferSize = cfg.ReadBufferSize
+	down.Upgrader.WriteBufferSize = cfg.WriteBufferSize
+	down.TLSConfig = serverTLS
 
-			select {
-			case messageChan <- msg:
-			default:
-				fmt.Println("relay chan full")
-			}
+	r := relay.New(cfg, ups, down)
+	if err := r.Start(context.Background()); err != nil {
+		log.Fatal(err)
+	}
 
+	select {
+	case <-ctx.Done():
+		log.Println("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		if err := r.Shutdown(shutdownCtx); err != nil {
+			log.Println("shutdown:", err)
 		}
-	})
-	http.ListenAndServe(":8081", nil)
+		cancel()
+	case <-r.Done():
+	}
+
+	r.Wait()
 }
@@ -1,79 +1,222 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"github.com/gorilla/websocket"
+	"go-relay/capture"
+	"go-relay/clock"
 	"go-relay/cmd/conf"
+	"go-relay/echo"
+	"go-relay/envelope"
+	"go-relay/metrics"
+	"go-relay/pacer"
+	"go-relay/payload"
+	"go-relay/tlsconf"
 	"log"
-	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime"
+	"sync"
+	"syscall"
 	"time"
 )
 
 var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  conf.ReadBufferSize,
-		WriteBufferSize: conf.WriteBufferSize,
-	}
+	sentTotal   = metrics.NewCounter("sender_messages_sent_total", "Messages written to relays.")
+	connections = metrics.NewGauge("sender_connections", "Connected relays.")
 )
 
 func main() {
-	if conf.PayloadMaxBytes < conf.PayloadMinBytes {
-		log.Fatal("PayloadMaxBytes must be greater or equal to PayloadMinBytes")
+	cfg, err := conf.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+	metrics.Serve(cfg.MetricsAddr)
+
+	replay, err := capture.LoadReplay(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	clk := clock.FromConfig(cfg)
+	if cfg.ClockListen != "" {
+		go func() {
+			log.Fatal(clock.Serve(cfg.ClockListen, clk))
+		}()
 	}
 
-	messageChan := make(chan []byte, conf.MessageChanSize)
+	var rtt *echo.Tracker
+	if cfg.EchoListen != "" {
+		rtt = echo.NewTracker(cfg.EchoWindow)
+		go func() {
+			log.Fatal(rtt.Serve(cfg.EchoListen))
+		}()
+	}
+
+	upgrader := websocket.Upgrader{
+		ReadBufferSize:  cfg.ReadBufferSize,
+		WriteBufferSize: cfg.WriteBufferSize,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	messageChan := make(chan []byte, cfg.MessageChanSize)
 
-	// Create messages
+	// Closed when the first relay connects.
+	connected := make(chan struct{})
+	var connectOnce sync.Once
+
+	// Create messages until shutdown, then close messageChan so the
+	// connections drain it.
 	go func() {
-		prng := rand.New(rand.NewSource(conf.RandSeed))
+		defer close(messageChan)
 
-		for {
-			if conf.SenderThrottleMillis > 0 {
-				time.Sleep(conf.SenderThrottleMillis * time.Millisecond)
-			}
+		payloads := payload.FromConfig(cfg, replay)
 
-			//// Generate random payload (2-4096 bytes)
-			length := prng.Intn(conf.PayloadMaxBytes-conf.PayloadMinBytes) + conf.PayloadMinBytes
-			data := make([]byte, length)
-			prng.Read(data)
+		pace := pacer.New(cfg, replay)
+		sequencer := envelope.NewSequencer(uint32(cfg.SenderID), cfg.TopicList())
+
+		// The schedule starts with the first relay; before it, messages
+		// would queue up in messageChan and their wait count as latency.
+		if pace != nil {
+			select {
+			case <-connected:
+			case <-ctx.Done():
+				return
+			}
+		}
 
-			buf := bytes.NewBuffer(make([]byte, 0, conf.TimestampBytes+length))
+		for {
+			if cfg.Throttled() {
+				time.Sleep(cfg.SenderThrottle())
+			}
 
-			// Prepend timestamp (int64, 8 bytes)
-			binary.Write(buf, binary.BigEndian, time.Now().UnixNano())
-			buf.Write(data)
+			data := payloads.Next()
 
-			payloadBytes := buf.Bytes()
+			h := sequencer.Next()
+			if pace != nil {
+				at, ok := pace.Wait(ctx)
+				if !ok {
+					return
+				}
+				h.IntendedTime = clk.At(at)
+			}
+			msg := envelope.Encode(
+				make([]byte, 0, envelope.Size(h.Topic, len(data))),
+				h,
+				data,
+			)
 
 			select {
-			case messageChan <- payloadBytes:
+			case messageChan <- msg:
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 
-	http.HandleFunc("/sender", func(w http.ResponseWriter, r *http.Request) {
-		if conf.LockOSThread {
+	var conns sync.WaitGroup
+	http.HandleFunc(cfg.SenderPath, func(w http.ResponseWriter, r *http.Request) {
+		// Added before the upgrade, which hides the connection from
+		// srv.Shutdown.
+		conns.Add(1)
+		defer conns.Done()
+
+		if cfg.LockOSThread {
 			runtime.LockOSThread()
 			defer runtime.UnlockOSThread()
 		}
 
-		conn, _ := upgrader.Upgrade(w, r, nil)
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
 		defer conn.Close()
 
+		connections.Inc()
+		defer connections.Dec()
+		connectOnce.Do(func() { close(connected) })
+
+		// Relays never send data frames, but reading is the only way to
+		// see their close frame or a dropped socket while messageChan is
+		// idle.
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
 		for {
 			select {
-			case msg := <-messageChan:
-				// Send message
-				conn.WriteMessage(websocket.BinaryMessage, msg)
+			case <-closed:
+				return
+			case msg, ok := <-messageChan:
+				if !ok {
+					closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+					_ = conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+					return
+				}
+
+				// Stamp and send message
+				envelope.SetSendTime(msg, clk.Now())
+				if rtt != nil {
+					rtt.Sent(msg)
+				}
+				// Once a write fails gorilla fails every later one too, so
+				// leave messageChan to the relays that are still connected.
+				if err := conn.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+					return
+				}
+				sentTotal.Inc()
 			default:
-				if conf.UseGosched {
+				if cfg.UseGosched {
 					runtime.Gosched()
-				} 
+				}
 			}
 		}
 	})
-	http.ListenAndServe(":8080", nil)
+
+	serverTLS, err := tlsconf.Server(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	srv := &http.Server{Addr: cfg.SenderListen, TLSConfig: serverTLS}
+	go func() {
+		var err error
+		if serverTLS != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("shutting down")
+
+	// Stop accepting relays, then give the connected ones until the
+	// deadline to drain messageChan.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	_ = srv.Shutdown(shutdownCtx)
+
+	drained := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		log.Println("shutdown: connections still open")
+	}
 }
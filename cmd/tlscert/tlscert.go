@@ -0,0 +1,26 @@
+package main
+
+import (
+	"flag"
+	"go-relay/tlsconf"
+	"log"
+	"os"
+	"strings"
+)
+
+func main() {
+	var dir, hosts string
+
+	flag.StringVar(&dir, "dir", ".", "directory ca.pem, cert.pem and key.pem are written to")
+	flag.StringVar(&hosts, "hosts", strings.Join(tlsconf.Hosts, ","), "comma-separated names and addresses the certificate is valid for")
+	flag.Parse()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Fatal(err)
+	}
+	files, err := tlsconf.Generate(dir, strings.Split(hosts, ","))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %v, %v and %v", files.CA, files.Cert, files.Key)
+}
@@ -0,0 +1,182 @@
+// Package echo measures round trips from senders to receivers and back,
+// which needs no clock sync. Receivers reflect the header of every envelope
+// they read straight back to its sender over UDP. The sender looks up when
+// it wrote the message, on its monotonic clock, and replies with the round
+// trip, 12 bytes little-endian:
+//
+//	offset  size  field
+//	0       4     magic "GREC"
+//	4       8     round trip, ns
+//
+// The way back skips the relay, so half the round trip estimates the one-way
+// latency only as far as both ways take as long.
+package echo
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"go-relay/envelope"
+	"go-relay/metrics"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	Magic uint32 = 0x43455247 // "GREC" on the wire
+
+	replySize = 12
+
+	// maxEcho bounds an echoed header, with the longest topic.
+	maxEcho = envelope.HeaderSize + envelope.MaxTopicLen
+)
+
+var (
+	rttSecs   = metrics.NewHistogram("sender_rtt_seconds", "Round trips of echoed messages.", metrics.LatencyBuckets)
+	unmatched = metrics.NewCounter("sender_echoes_unmatched_total", "Echoes of messages no longer or never remembered.")
+)
+
+type key struct {
+	senderID uint32
+	seq      uint64
+	sendTime int64
+}
+
+func keyOf(h envelope.Header) key {
+	return key{senderID: h.SenderID, seq: h.Seq, sendTime: h.SendTime}
+}
+
+// Tracker remembers when a sender wrote its last window messages, to answer
+// their echoes.
+type Tracker struct {
+	mu    sync.Mutex
+	sent  map[key]time.Time
+	order []key // ring of the keys in sent
+	next  int   // oldest key in order once it is full
+}
+
+func NewTracker(window int) *Tracker {
+	return &Tracker{
+		sent:  make(map[key]time.Time, window),
+		order: make([]key, 0, window),
+	}
+}
+
+// Sent records that msg, with its send time stamped, is written now.
+func (t *Tracker) Sent(msg []byte) {
+	h, err := envelope.DecodeHeader(msg)
+	if err != nil {
+		return
+	}
+	k := keyOf(h)
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.order) < cap(t.order) {
+		t.order = append(t.order, k)
+	} else {
+		delete(t.sent, t.order[t.next])
+		t.order[t.next] = k
+		t.next = (t.next + 1) % len(t.order)
+	}
+	t.sent[k] = now
+}
+
+// rtt returns the round trip of the message an echo is of.
+func (t *Tracker) rtt(echo []byte) (time.Duration, bool) {
+	h, err := envelope.DecodeHeader(echo)
+	if err != nil {
+		return 0, false
+	}
+
+	t.mu.Lock()
+	sent, ok := t.sent[keyOf(h)]
+	t.mu.Unlock()
+	if !ok {
+		return 0, false
+	}
+	return time.Since(sent), true
+}
+
+// Serve answers echoes on the UDP address addr. It only returns on errors.
+func (t *Tracker) Serve(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, maxEcho)
+	reply := make([]byte, replySize)
+	binary.LittleEndian.PutUint32(reply, Magic)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		rtt, ok := t.rtt(buf[:n])
+		if !ok {
+			unmatched.Inc()
+			continue
+		}
+		rttSecs.Observe(rtt.Seconds())
+
+		binary.LittleEndian.PutUint64(reply[4:], uint64(rtt))
+		_, _ = conn.WriteTo(reply, from)
+	}
+}
+
+// Reflector echoes messages back to their sender.
+type Reflector struct {
+	conn net.Conn
+}
+
+// Dial returns a reflector to the sender tracker served at the UDP address
+// addr.
+func Dial(addr string) (*Reflector, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Reflector{conn: conn}, nil
+}
+
+// Reflect echoes the header of msg, if it is an envelope. It is safe to call
+// from several goroutines.
+func (r *Reflector) Reflect(msg []byte) {
+	topic := envelope.RawTopic(msg)
+	if topic == nil {
+		return
+	}
+	_, _ = r.conn.Write(msg[:envelope.HeaderSize+len(topic)])
+}
+
+// Run passes the round trips the sender replies with to fn until ctx is
+// done, then closes the reflector.
+func (r *Reflector) Run(ctx context.Context, fn func(rtt time.Duration)) {
+	stop := context.AfterFunc(ctx, func() {
+		r.conn.Close()
+	})
+	defer stop()
+
+	buf := make([]byte, replySize)
+	for {
+		n, err := r.conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// A sender not listening yet refuses echoes, which a
+			// connected UDP socket reports on the next read.
+			continue
+		}
+		if n != replySize || binary.LittleEndian.Uint32(buf) != Magic {
+			continue
+		}
+		fn(time.Duration(binary.LittleEndian.Uint64(buf[4:])))
+	}
+}
@@ -0,0 +1,223 @@
+// Package envelope defines the wire format of benchmark messages. Every
+// sender, relay and receiver speaks it, so stacks can be mixed freely.
+//
+// All fields are little-endian:
+//
+//	offset  size  field
+//	0       4     magic "GRLY"
+//	4       1     version
+//	5       1     flags
+//	6       2     topic length t
+//	8       8     sequence number
+//	16      8     send timestamp, unix nanoseconds
+//	24      4     sender ID
+//	28      4     payload length n
+//	32      8     intended send time, unix nanoseconds, 0 if unscheduled
+//	40      t     topic, empty for untagged messages
+//	40+t    n     payload
+//
+// With FlagHops set, every relay the message passed through appended a hop
+// after the payload:
+//
+//	offset  size  field
+//	0       8     ingress, read from upstream, unix nanoseconds
+//	8       8     egress, written to the subscriber, unix nanoseconds
+package envelope
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	Magic   uint32 = 0x594c5247 // "GRLY" on the wire
+	Version uint8  = 2
+
+	HeaderSize = 40
+
+	MaxTopicLen = 1<<16 - 1
+
+	// FlagHops marks an envelope followed by hops.
+	FlagHops uint8 = 1 << 0
+
+	HopSize = 16
+
+	sendTimeOffset     = 16
+	intendedTimeOffset = 32
+)
+
+var (
+	ErrShort   = errors.New("envelope: message shorter than header")
+	ErrMagic   = errors.New("envelope: bad magic")
+	ErrVersion = errors.New("envelope: unsupported version")
+	ErrLength  = errors.New("envelope: payload length mismatch")
+)
+
+// Header is the fixed part of an envelope.
+type Header struct {
+	Version  uint8
+	Flags    uint8
+	Seq      uint64
+	SendTime int64 // unix nanoseconds
+	SenderID uint32
+	Topic    string
+
+	// IntendedTime is when an open-loop sender was scheduled to send the
+	// message, in unix nanoseconds; 0 if it was not.
+	IntendedTime int64
+}
+
+// Hop is the passage of a message through a relay, on the relay's clock.
+type Hop struct {
+	Ingress int64 // unix nanoseconds
+	Egress  int64 // unix nanoseconds
+}
+
+// Envelope is a decoded message. Payload aliases the decoded buffer.
+type Envelope struct {
+	Header
+	Payload []byte
+	Hops    []Hop
+}
+
+// Encode appends the envelope for h and payload to dst. The version is
+// always set to Version. It panics if the topic exceeds MaxTopicLen.
+func Encode(dst []byte, h Header, payload []byte) []byte {
+	if len(h.Topic) > MaxTopicLen {
+		panic("envelope: topic too long")
+	}
+
+	var hdr [HeaderSize]byte
+
+	binary.LittleEndian.PutUint32(hdr[0:], Magic)
+	hdr[4] = Version
+	hdr[5] = h.Flags
+	binary.LittleEndian.PutUint16(hdr[6:], uint16(len(h.Topic)))
+	binary.LittleEndian.PutUint64(hdr[8:], h.Seq)
+	binary.LittleEndian.PutUint64(hdr[sendTimeOffset:], uint64(h.SendTime))
+	binary.LittleEndian.PutUint32(hdr[24:], h.SenderID)
+	binary.LittleEndian.PutUint32(hdr[28:], uint32(len(payload)))
+	binary.LittleEndian.PutUint64(hdr[intendedTimeOffset:], uint64(h.IntendedTime))
+
+	dst = append(dst, hdr[:]...)
+	dst = append(dst, h.Topic...)
+	return append(dst, payload...)
+}
+
+// Size is the encoded size of an envelope.
+func Size(topic string, payloadLen int) int {
+	return HeaderSize + len(topic) + payloadLen
+}
+
+// Decode parses an envelope without copying the payload.
+func Decode(b []byte) (Envelope, error) {
+	var e Envelope
+
+	h, err := DecodeHeader(b)
+	if err != nil {
+		return e, err
+	}
+	e.Header = h
+
+	t := len(h.Topic)
+	end := HeaderSize + t + int(binary.LittleEndian.Uint32(b[28:]))
+	hops := len(b) - end
+	if hops < 0 || hops > 0 && (h.Flags&FlagHops == 0 || hops%HopSize != 0) {
+		return e, ErrLength
+	}
+	e.Payload = b[HeaderSize+t : end]
+
+	for i := end; i < len(b); i += HopSize {
+		e.Hops = append(e.Hops, Hop{
+			Ingress: int64(binary.LittleEndian.Uint64(b[i:])),
+			Egress:  int64(binary.LittleEndian.Uint64(b[i+8:])),
+		})
+	}
+
+	return e, nil
+}
+
+// DecodeHeader parses the header and topic of an envelope whose payload may
+// be cut off.
+func DecodeHeader(b []byte) (Header, error) {
+	var h Header
+
+	if len(b) < HeaderSize {
+		return h, ErrShort
+	}
+	if binary.LittleEndian.Uint32(b[0:]) != Magic {
+		return h, ErrMagic
+	}
+
+	h.Version = b[4]
+	if h.Version != Version {
+		return h, fmt.Errorf("%w %d", ErrVersion, h.Version)
+	}
+
+	t := int(binary.LittleEndian.Uint16(b[6:]))
+	if HeaderSize+t > len(b) {
+		return h, ErrShort
+	}
+
+	h.Flags = b[5]
+	h.Seq = binary.LittleEndian.Uint64(b[8:])
+	h.SendTime = int64(binary.LittleEndian.Uint64(b[sendTimeOffset:]))
+	h.SenderID = binary.LittleEndian.Uint32(b[24:])
+	h.IntendedTime = int64(binary.LittleEndian.Uint64(b[intendedTimeOffset:]))
+	h.Topic = string(b[HeaderSize : HeaderSize+t])
+
+	return h, nil
+}
+
+// RawTopic returns the topic of an encoded envelope without copying it, or
+// nil if b is not an envelope.
+func RawTopic(b []byte) []byte {
+	if len(b) < HeaderSize || binary.LittleEndian.Uint32(b[0:]) != Magic {
+		return nil
+	}
+
+	t := int(binary.LittleEndian.Uint16(b[6:]))
+	if HeaderSize+t > len(b) {
+		return nil
+	}
+	return b[HeaderSize : HeaderSize+t]
+}
+
+// RawSenderID returns the sender ID of an encoded envelope, or false if b is
+// not an envelope.
+func RawSenderID(b []byte) (uint32, bool) {
+	if len(b) < HeaderSize || binary.LittleEndian.Uint32(b[0:]) != Magic {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(b[24:]), true
+}
+
+// SetSendTime overwrites the send timestamp of an encoded envelope, so
+// messages can be built ahead of time and stamped just before writing.
+func SetSendTime(b []byte, unixNano int64) {
+	binary.LittleEndian.PutUint64(b[sendTimeOffset:], uint64(unixNano))
+}
+
+// AppendHop appends a hop read at ingress to an encoded envelope, its egress
+// left to SetEgress. Messages that are not envelopes are returned as is.
+func AppendHop(b []byte, ingress int64) []byte {
+	if len(b) < HeaderSize || binary.LittleEndian.Uint32(b[0:]) != Magic {
+		return b
+	}
+
+	b[5] |= FlagHops
+
+	var hop [HopSize]byte
+	binary.LittleEndian.PutUint64(hop[0:], uint64(ingress))
+	return append(b, hop[:]...)
+}
+
+// SetEgress overwrites the egress of the last hop of an encoded envelope, if
+// it has hops.
+func SetEgress(b []byte, unixNano int64) {
+	if len(b) < HeaderSize+HopSize || binary.LittleEndian.Uint32(b[0:]) != Magic || b[5]&FlagHops == 0 {
+		return
+	}
+	binary.LittleEndian.PutUint64(b[len(b)-8:], uint64(unixNano))
+}
@@ -0,0 +1,185 @@
+package envelope
+
+import (
+	"bytes"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  Header
+		payload []byte
+		hops    []Hop
+	}{
+		{
+			name:   "empty",
+			header: Header{Seq: 1, SenderID: 1},
+		},
+		{
+			name:    "topic and payload",
+			header:  Header{Seq: 42, SendTime: 1_700_000_000_123_456_789, SenderID: 7, Topic: "btc"},
+			payload: []byte("hello"),
+		},
+		{
+			name:    "scheduled",
+			header:  Header{Seq: 1 << 40, SendTime: 2, SenderID: 1<<32 - 1, IntendedTime: 1},
+			payload: bytes.Repeat([]byte{0xff}, 4096),
+		},
+		{
+			name:    "long topic",
+			header:  Header{Seq: 3, Topic: strings.Repeat("t", MaxTopicLen)},
+			payload: []byte{0},
+		},
+		{
+			name:    "one hop",
+			header:  Header{Seq: 9, SendTime: 100, SenderID: 2, Topic: "eth"},
+			payload: []byte("payload"),
+			hops:    []Hop{{Ingress: 150, Egress: 170}},
+		},
+		{
+			name:   "hops without payload",
+			header: Header{Seq: 10, SendTime: 100},
+			hops:   []Hop{{Ingress: 150, Egress: 170}, {Ingress: 200, Egress: 260}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Encode(nil, tt.header, tt.payload)
+			if len(b) != Size(tt.header.Topic, len(tt.payload)) {
+				t.Errorf("encoded %v bytes, Size says %v", len(b), Size(tt.header.Topic, len(tt.payload)))
+			}
+			for _, hop := range tt.hops {
+				b = AppendHop(b, hop.Ingress)
+				SetEgress(b, hop.Egress)
+			}
+
+			e, err := Decode(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.header
+			want.Version = Version
+			if len(tt.hops) > 0 {
+				want.Flags |= FlagHops
+			}
+			if e.Header != want {
+				t.Errorf("header %+v, want %+v", e.Header, want)
+			}
+			if !bytes.Equal(e.Payload, tt.payload) {
+				t.Errorf("payload %q, want %q", e.Payload, tt.payload)
+			}
+			if !slices.Equal(e.Hops, tt.hops) {
+				t.Errorf("hops %v, want %v", e.Hops, tt.hops)
+			}
+
+			h, err := DecodeHeader(b[:HeaderSize+len(tt.header.Topic)])
+			if err != nil || h != want {
+				t.Errorf("DecodeHeader = %+v, %v, want %+v", h, err, want)
+			}
+			if topic := RawTopic(b); string(topic) != tt.header.Topic {
+				t.Errorf("RawTopic = %q, want %q", topic, tt.header.Topic)
+			}
+			if id, ok := RawSenderID(b); !ok || id != tt.header.SenderID {
+				t.Errorf("RawSenderID = %v, %v, want %v", id, ok, tt.header.SenderID)
+			}
+		})
+	}
+}
+
+func TestSetSendTime(t *testing.T) {
+	b := Encode(nil, Header{Seq: 1, Topic: "a"}, []byte("x"))
+	b = AppendHop(b, 5)
+	SetSendTime(b, 123)
+
+	e, err := Decode(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.SendTime != 123 || e.Seq != 1 || string(e.Payload) != "x" || len(e.Hops) != 1 {
+		t.Errorf("decoded %+v", e)
+	}
+}
+
+func TestNotEnvelope(t *testing.T) {
+	msg := []byte("ready")
+	if got := AppendHop(msg, 1); !bytes.Equal(got, msg) {
+		t.Errorf("AppendHop changed %q to %q", msg, got)
+	}
+	SetEgress(msg, 1)
+	if string(msg) != "ready" {
+		t.Errorf("SetEgress changed the message to %q", msg)
+	}
+	if RawTopic(msg) != nil {
+		t.Error("RawTopic of a non-envelope")
+	}
+	if _, ok := RawSenderID(msg); ok {
+		t.Error("RawSenderID of a non-envelope")
+	}
+
+	// Without hops, SetEgress must not touch the payload.
+	b := Encode(nil, Header{Seq: 1}, bytes.Repeat([]byte{1}, HopSize))
+	SetEgress(b, -1)
+	if e, err := Decode(b); err != nil || !bytes.Equal(e.Payload, bytes.Repeat([]byte{1}, HopSize)) {
+		t.Errorf("SetEgress without hops: %v, %v", e.Payload, err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	valid := Encode(nil, Header{Seq: 1, Topic: "topic"}, []byte("payload"))
+
+	corrupt := func(f func(b []byte) []byte) []byte {
+		return f(slices.Clone(valid))
+	}
+
+	tests := []struct {
+		name string
+		msg  []byte
+		want error
+	}{
+		{name: "empty", msg: nil, want: ErrShort},
+		{name: "short header", msg: valid[:HeaderSize-1], want: ErrShort},
+		{name: "short topic", msg: valid[:HeaderSize+2], want: ErrShort},
+		{name: "bad magic", msg: corrupt(func(b []byte) []byte { b[0] = 'X'; return b }), want: ErrMagic},
+		{name: "old version", msg: corrupt(func(b []byte) []byte { b[4] = 1; return b }), want: ErrVersion},
+		{name: "cut payload", msg: valid[:len(valid)-1], want: ErrLength},
+		{name: "trailing bytes without hops", msg: append(slices.Clone(valid), make([]byte, HopSize)...), want: ErrLength},
+		{name: "partial hop", msg: append(AppendHop(slices.Clone(valid), 1), 0), want: ErrLength},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Decode(tt.msg); !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSequencer(t *testing.T) {
+	s := NewSequencer(3, []string{"a", "b"})
+
+	want := []Header{
+		{Seq: 1, SenderID: 3, Topic: "a"},
+		{Seq: 1, SenderID: 3, Topic: "b"},
+		{Seq: 2, SenderID: 3, Topic: "a"},
+		{Seq: 2, SenderID: 3, Topic: "b"},
+	}
+	for i, w := range want {
+		if got := s.Next(); got != w {
+			t.Errorf("message %v: %+v, want %+v", i, got, w)
+		}
+	}
+
+	untagged := NewSequencer(1, nil)
+	for seq := uint64(1); seq <= 3; seq++ {
+		if got := untagged.Next(); got.Seq != seq || got.Topic != "" {
+			t.Errorf("untagged message %+v, want seq %v", got, seq)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package envelope
+
+// Sequencer numbers the messages of a sender. Messages cycle through the
+// topics, each with its own sequence starting at 1, so a receiver of one
+// topic sees no gaps.
+type Sequencer struct {
+	senderID uint32
+	topics   []string
+	seqs     []uint64
+	next     int
+}
+
+// NewSequencer returns a Sequencer for topics, or for untagged messages
+// when there are none.
+func NewSequencer(senderID uint32, topics []string) *Sequencer {
+	if len(topics) == 0 {
+		topics = []string{""}
+	}
+	return &Sequencer{
+		senderID: senderID,
+		topics:   topics,
+		seqs:     make([]uint64, len(topics)),
+	}
+}
+
+// Next returns the header of the next message. The send time is left to
+// SetSendTime, and the intended time to open-loop senders.
+func (s *Sequencer) Next() Header {
+	i := s.next
+	s.next = (s.next + 1) % len(s.topics)
+
+	s.seqs[i]++
+	return Header{Seq: s.seqs[i], SenderID: s.senderID, Topic: s.topics[i]}
+}
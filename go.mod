@@ -8,6 +8,7 @@ require (
 	github.com/lxzan/gws v1.8.9
 	github.com/xtaci/kcp-go v4.3.4+incompatible
 	golang.org/x/sys v0.33.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,127 @@
+// Package kcpconn carries benchmark messages over KCP, a reliable protocol
+// on top of UDP. KCP runs in stream mode and every message is prefixed with
+// its length, so message boundaries survive any MTU.
+package kcpconn
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"go-relay/cmd/conf"
+	"io"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+)
+
+const (
+	// MaxMessageSize bounds the length prefix accepted from a peer.
+	MaxMessageSize = 16 << 20
+
+	// WriteTimeout bounds how long a write waits for the send window. KCP
+	// has no connection teardown, so this is how a vanished peer is noticed.
+	WriteTimeout = 5 * time.Second
+)
+
+// Conn is a message-oriented KCP session.
+type Conn struct {
+	sess   *kcp.UDPSession
+	reader *bufio.Reader
+}
+
+// Dial connects to a KCP listener. KCP listeners only learn about a
+// session from its first packet, so callers should write a message first.
+func Dial(addr string, cfg *conf.Config) (*Conn, error) {
+	sess, err := kcp.DialWithOptions(addr, nil, cfg.KCPDataShards, cfg.KCPParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return newConn(sess, cfg), nil
+}
+
+// Listener accepts KCP sessions.
+type Listener struct {
+	cfg *conf.Config
+	l   *kcp.Listener
+}
+
+func Listen(addr string, cfg *conf.Config) (*Listener, error) {
+	l, err := kcp.ListenWithOptions(addr, nil, cfg.KCPDataShards, cfg.KCPParityShards)
+	if err != nil {
+		return nil, err
+	}
+	return &Listener{cfg: cfg, l: l}, nil
+}
+
+func (l *Listener) Accept() (*Conn, error) {
+	sess, err := l.l.AcceptKCP()
+	if err != nil {
+		return nil, err
+	}
+	return newConn(sess, l.cfg), nil
+}
+
+func (l *Listener) Close() error {
+	return l.l.Close()
+}
+
+func newConn(sess *kcp.UDPSession, cfg *conf.Config) *Conn {
+	sess.SetStreamMode(true)
+	sess.SetWriteDelay(false)
+	sess.SetACKNoDelay(cfg.KCPNoDelay)
+	sess.SetNoDelay(boolToInt(cfg.KCPNoDelay), cfg.KCPInterval, cfg.KCPResend, boolToInt(cfg.KCPNoCongestion))
+	sess.SetWindowSize(cfg.KCPSendWindow, cfg.KCPRecvWindow)
+	sess.SetMtu(cfg.KCPMTU)
+
+	return &Conn{
+		sess:   sess,
+		reader: bufio.NewReaderSize(sess, 64*1024),
+	}
+}
+
+// ReadMessage blocks until a whole message has arrived. It must not be
+// called concurrently.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(c.reader, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.LittleEndian.Uint32(prefix[:])
+	if n > MaxMessageSize {
+		return nil, fmt.Errorf("kcp message of %d bytes exceeds %d", n, MaxMessageSize)
+	}
+
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(c.reader, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteMessage sends msg with a single session write, so it is safe to
+// call from several goroutines.
+func (c *Conn) WriteMessage(msg []byte) error {
+	buf := make([]byte, 4, 4+len(msg))
+	binary.LittleEndian.PutUint32(buf, uint32(len(msg)))
+	buf = append(buf, msg...)
+
+	_ = c.sess.SetWriteDeadline(time.Now().Add(WriteTimeout))
+	_, err := c.sess.Write(buf)
+	return err
+}
+
+func (c *Conn) RemoteAddr() string {
+	return c.sess.RemoteAddr().String()
+}
+
+func (c *Conn) Close() error {
+	return c.sess.Close()
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
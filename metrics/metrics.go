@@ -0,0 +1,269 @@
+// Package metrics exposes counters, gauges and histograms in the Prometheus
+// text format, so long runs of any role can be scraped.
+//
+// A metric name may carry constant labels, e.g.
+// `relay_messages_dropped_total{reason="chan_full"}`; metrics sharing the
+// name before the labels form one family.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the registry served by Serve and used by the package functions.
+var Default = NewRegistry()
+
+type metric interface {
+	kind() string
+	write(w io.Writer, name string)
+}
+
+type entry struct {
+	name   string
+	help   string
+	metric metric
+}
+
+// Registry holds named metrics. Asking for a name twice returns the metric
+// registered first, so packages can declare their metrics independently.
+type Registry struct {
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{entries: make(map[string]*entry)}
+}
+
+func (r *Registry) register(name, help string, m metric) metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if e, ok := r.entries[name]; ok {
+		if e.metric.kind() != m.kind() {
+			panic(fmt.Sprintf("metrics: %v registered as %v and %v", name, e.metric.kind(), m.kind()))
+		}
+		return e.metric
+	}
+
+	r.entries[name] = &entry{name: name, help: help, metric: m}
+	return m
+}
+
+func (r *Registry) Counter(name, help string) *Counter {
+	return r.register(name, help, &Counter{}).(*Counter)
+}
+
+func (r *Registry) Gauge(name, help string) *Gauge {
+	return r.register(name, help, &Gauge{}).(*Gauge)
+}
+
+// GaugeFunc reports the value of fn at every scrape. Registering a name
+// again replaces fn, so the latest owner of a resource reports it.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	g := r.register(name, help, &gaugeFunc{}).(*gaugeFunc)
+	g.fn.Store(&fn)
+}
+
+// Histogram counts observations into buckets with the given upper bounds,
+// which must be increasing.
+func (r *Registry) Histogram(name, help string, buckets []float64) *Histogram {
+	return r.register(name, help, newHistogram(buckets)).(*Histogram)
+}
+
+// WriteText writes every metric in the Prometheus text format.
+func (r *Registry) WriteText(w io.Writer) {
+	r.mu.Lock()
+	entries := make([]*entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		fi, fj := familyName(entries[i].name), familyName(entries[j].name)
+		if fi != fj {
+			return fi < fj
+		}
+		return entries[i].name < entries[j].name
+	})
+
+	family := ""
+	for _, e := range entries {
+		if f := familyName(e.name); f != family {
+			family = f
+			fmt.Fprintf(w, "# HELP %v %v\n", f, e.help)
+			fmt.Fprintf(w, "# TYPE %v %v\n", f, e.metric.kind())
+		}
+		e.metric.write(w, e.name)
+	}
+}
+
+// ServeHTTP serves the registry as a /metrics endpoint.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteText(w)
+}
+
+func NewCounter(name, help string) *Counter { return Default.Counter(name, help) }
+func NewGauge(name, help string) *Gauge     { return Default.Gauge(name, help) }
+
+func NewGaugeFunc(name, help string, fn func() float64) { Default.GaugeFunc(name, help, fn) }
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.Histogram(name, help, buckets)
+}
+
+// Serve exposes Default on addr at /metrics in the background. An empty
+// addr does nothing.
+func Serve(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Default)
+
+	go func() {
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Println("metrics:", err)
+		}
+	}()
+}
+
+// Counter only goes up.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc()          { c.v.Add(1) }
+func (c *Counter) Add(n uint64)  { c.v.Add(n) }
+func (c *Counter) Value() uint64 { return c.v.Load() }
+func (c *Counter) kind() string  { return "counter" }
+func (c *Counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%v %v\n", name, c.Value())
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Set(v int64)  { g.v.Store(v) }
+func (g *Gauge) Inc()         { g.v.Add(1) }
+func (g *Gauge) Dec()         { g.v.Add(-1) }
+func (g *Gauge) Value() int64 { return g.v.Load() }
+func (g *Gauge) kind() string { return "gauge" }
+func (g *Gauge) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%v %v\n", name, g.Value())
+}
+
+type gaugeFunc struct {
+	fn atomic.Pointer[func() float64]
+}
+
+func (g *gaugeFunc) kind() string { return "gauge" }
+func (g *gaugeFunc) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%v %v\n", name, formatFloat((*g.fn.Load())()))
+}
+
+// Histogram is a cumulative Prometheus histogram.
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64 // one more than bounds, for +Inf
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(bounds []float64) *Histogram {
+	return &Histogram{
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.mu.Lock()
+	h.buckets[i]++
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+func (h *Histogram) kind() string { return "histogram" }
+
+func (h *Histogram) write(w io.Writer, name string) {
+	h.mu.Lock()
+	buckets := append([]uint64(nil), h.buckets...)
+	count, sum := h.count, h.sum
+	h.mu.Unlock()
+
+	family, labels := familyName(name), labelsOf(name)
+
+	var cumulative uint64
+	for i, n := range buckets {
+		cumulative += n
+
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = formatFloat(h.bounds[i])
+		}
+		fmt.Fprintf(w, "%v_bucket{%vle=%q} %v\n", family, labels, le, cumulative)
+	}
+
+	suffix := ""
+	if labels != "" {
+		suffix = "{" + strings.TrimSuffix(labels, ",") + "}"
+	}
+	fmt.Fprintf(w, "%v_sum%v %v\n", family, suffix, formatFloat(sum))
+	fmt.Fprintf(w, "%v_count%v %v\n", family, suffix, count)
+}
+
+// ExponentialBuckets returns n bounds starting at start, each factor times
+// the previous.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	bounds := make([]float64, n)
+	for i := range bounds {
+		bounds[i] = start
+		start *= factor
+	}
+	return bounds
+}
+
+// LatencyBuckets spans 10µs to about 10s, in seconds.
+var LatencyBuckets = ExponentialBuckets(10e-6, 2, 21)
+
+func familyName(name string) string {
+	family, _, _ := strings.Cut(name, "{")
+	return family
+}
+
+// labelsOf returns the labels of name followed by a comma, or "".
+func labelsOf(name string) string {
+	_, labels, ok := strings.Cut(name, "{")
+	if !ok {
+		return ""
+	}
+	return strings.TrimSuffix(labels, "}") + ","
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,106 @@
+// Package pacer schedules the messages of an open-loop sender. The schedule
+// follows the send rate, or the timing of a replayed capture, whatever
+// happens downstream: a stalled pipeline
+// delays messages past their intended time rather than delaying the
+// schedule, so receivers measure the stall instead of omitting it.
+package pacer
+
+import (
+	"context"
+	"go-relay/capture"
+	"go-relay/cmd/conf"
+	"math/rand"
+	"time"
+)
+
+type Pacer struct {
+	mode     string
+	interval float64 // mean nanoseconds between messages
+	burst    int
+	prng     *rand.Rand
+
+	gaps []int64 // between replayed messages, ns
+
+	next int64 // intended time of the next message, unix ns
+	sent int   // messages of the current burst or replay
+}
+
+// New returns the pacer for cfg, or nil when the sender runs closed-loop.
+// With a capture to replay, messages follow its timing scaled by the replay
+// speed.
+func New(cfg *conf.Config, replay []capture.Record) *Pacer {
+	if len(replay) > 0 && cfg.ReplaySpeed > 0 {
+		return &Pacer{mode: "replay", gaps: gaps(replay, cfg.ReplaySpeed)}
+	}
+	if cfg.SendRate == 0 {
+		return nil
+	}
+	return &Pacer{
+		mode:     cfg.SendMode,
+		interval: float64(time.Second) / cfg.SendRate,
+		burst:    cfg.BurstSize,
+		prng:     rand.New(rand.NewSource(cfg.RandSeed)),
+	}
+}
+
+// Next returns the intended send time of the next message. The first
+// message is due now.
+func (p *Pacer) Next() int64 {
+	if p.next == 0 {
+		p.next = time.Now().UnixNano()
+	}
+	at := p.next
+
+	switch p.mode {
+	case "constant":
+		p.next += int64(p.interval)
+	case "poisson":
+		p.next += int64(p.prng.ExpFloat64() * p.interval)
+	case "burst":
+		p.sent++
+		if p.sent == p.burst {
+			p.sent = 0
+			p.next += int64(p.interval * float64(p.burst))
+		}
+	case "replay":
+		p.next += p.gaps[p.sent]
+		p.sent = (p.sent + 1) % len(p.gaps)
+	}
+
+	return at
+}
+
+// Wait returns the intended send time of the next message once it is due,
+// or false if ctx is done first. Behind schedule it returns at once, so the
+// sender catches up.
+func (p *Pacer) Wait(ctx context.Context) (int64, bool) {
+	at := p.Next()
+
+	d := time.Until(time.Unix(0, at))
+	if d <= 0 {
+		return at, ctx.Err() == nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return at, true
+	case <-ctx.Done():
+		return at, false
+	}
+}
+
+// gaps returns the time from each record to the next divided by speed. The
+// replay loops, so the last record is followed by the mean gap.
+func gaps(records []capture.Record, speed float64) []int64 {
+	gaps := make([]int64, len(records))
+	for i := range len(records) - 1 {
+		gaps[i] = int64(float64(max(records[i+1].Time-records[i].Time, 0)) / speed)
+	}
+	if n := len(records) - 1; n > 0 {
+		gaps[n] = int64(float64(max(records[n].Time-records[0].Time, 0)) / float64(n) / speed)
+	}
+	return gaps
+}
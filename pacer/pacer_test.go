@@ -0,0 +1,155 @@
+package pacer
+
+import (
+	"context"
+	"go-relay/capture"
+	"go-relay/cmd/conf"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+	ms := int64(time.Millisecond)
+
+	tests := []struct {
+		name   string
+		cfg    func(cfg *conf.Config)
+		replay []capture.Record
+		want   []int64 // due times after the first, which is due now
+	}{
+		{
+			name: "constant",
+			cfg:  func(cfg *conf.Config) { cfg.SendRate, cfg.SendMode = 100, "constant" },
+			want: []int64{10 * ms, 20 * ms, 30 * ms, 40 * ms},
+		},
+		{
+			name: "constant fractional",
+			cfg:  func(cfg *conf.Config) { cfg.SendRate, cfg.SendMode = 3, "constant" },
+			want: []int64{333_333_333, 666_666_666, 999_999_999},
+		},
+		{
+			name: "burst",
+			cfg:  func(cfg *conf.Config) { cfg.SendRate, cfg.SendMode, cfg.BurstSize = 100, "burst", 3 },
+			want: []int64{0, 0, 30 * ms, 30 * ms, 30 * ms, 60 * ms},
+		},
+		{
+			name: "burst of one",
+			cfg:  func(cfg *conf.Config) { cfg.SendRate, cfg.SendMode, cfg.BurstSize = 100, "burst", 1 },
+			want: []int64{10 * ms, 20 * ms, 30 * ms},
+		},
+		{
+			name: "replay",
+			cfg:  func(cfg *conf.Config) { cfg.ReplaySpeed = 1 },
+			replay: []capture.Record{
+				{Time: 100 * ms}, {Time: 105 * ms}, {Time: 120 * ms},
+			},
+			// Loops after the mean gap of 10ms.
+			want: []int64{5 * ms, 20 * ms, 30 * ms, 35 * ms, 50 * ms, 60 * ms},
+		},
+		{
+			name:   "replay at double speed",
+			cfg:    func(cfg *conf.Config) { cfg.ReplaySpeed = 2 },
+			replay: []capture.Record{{Time: 0}, {Time: 10 * ms}},
+			want:   []int64{5 * ms, 10 * ms, 15 * ms},
+		},
+		{
+			name:   "replay of one record",
+			cfg:    func(cfg *conf.Config) { cfg.ReplaySpeed = 1 },
+			replay: []capture.Record{{Time: 7}},
+			want:   []int64{0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := conf.Default()
+			tt.cfg(cfg)
+
+			p := New(cfg, tt.replay)
+			if p == nil {
+				t.Fatal("no pacer")
+			}
+
+			before := time.Now().UnixNano()
+			first := p.Next()
+			if first < before || first > time.Now().UnixNano() {
+				t.Errorf("first message due at %v, not now", first)
+			}
+
+			got := make([]int64, len(tt.want))
+			for i := range got {
+				got[i] = p.Next() - first
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("due after %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPoisson(t *testing.T) {
+	cfg := conf.Default()
+	cfg.SendRate, cfg.SendMode = 1000, "poisson"
+
+	const n = 10_000
+	run := func() []int64 {
+		p := New(cfg, nil)
+		due := make([]int64, n)
+		for i := range due {
+			due[i] = p.Next()
+		}
+		for i := n - 1; i >= 0; i-- {
+			due[i] -= due[0]
+		}
+		return due
+	}
+
+	a, b := run(), run()
+	if !slices.Equal(a, b) {
+		t.Error("schedules with the same seed differ")
+	}
+	if !slices.IsSorted(a) {
+		t.Error("schedule goes back in time")
+	}
+	// n gaps of 1ms on average.
+	if mean := time.Duration(a[n-1] / (n - 1)); mean < 950*time.Microsecond || mean > 1050*time.Microsecond {
+		t.Errorf("mean gap %v, want about 1ms", mean)
+	}
+}
+
+func TestClosedLoop(t *testing.T) {
+	if p := New(conf.Default(), nil); p != nil {
+		t.Error("pacer without a send rate")
+	}
+
+	cfg := conf.Default()
+	cfg.ReplaySpeed = 0
+	if p := New(cfg, []capture.Record{{Time: 1}, {Time: 2}}); p != nil {
+		t.Error("pacer replaying as fast as possible")
+	}
+}
+
+func TestWait(t *testing.T) {
+	cfg := conf.Default()
+	cfg.SendRate, cfg.SendMode = 10, "constant"
+	p := New(cfg, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	first, ok := p.Wait(ctx)
+	if !ok {
+		t.Fatal("first message not due")
+	}
+	second, ok := p.Wait(ctx)
+	if !ok || time.Now().UnixNano() < second || second-first != int64(100*time.Millisecond) {
+		t.Errorf("second message due %v after the first, %v, returned early or late", time.Duration(second-first), ok)
+	}
+
+	cancel()
+	start := time.Now()
+	if _, ok := p.Wait(ctx); ok || time.Since(start) > 50*time.Millisecond {
+		t.Error("Wait did not return on a done ctx")
+	}
+}
@@ -0,0 +1,121 @@
+package payload
+
+import (
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Content fills payloads.
+type Content interface {
+	Fill(b []byte)
+}
+
+// Random content is incompressible.
+type Random struct {
+	Rand *rand.Rand
+}
+
+func (r Random) Fill(b []byte) {
+	r.Rand.Read(b)
+}
+
+// Zeros content compresses as well as anything can.
+type Zeros struct{}
+
+func (Zeros) Fill(b []byte) {
+	clear(b)
+}
+
+const lorem = "Lorem ipsum dolor sit amet, consectetur adipiscing elit, sed do eiusmod " +
+	"tempor incididunt ut labore et dolore magna aliqua. Ut enim ad minim veniam, " +
+	"quis nostrud exercitation ullamco laboris nisi ut aliquip ex ea commodo consequat. "
+
+// Text content repeats a paragraph from a random offset, compressing like
+// prose.
+type Text struct {
+	Rand *rand.Rand
+}
+
+func (t *Text) Fill(b []byte) {
+	for n := copy(b, lorem[t.Rand.Intn(len(lorem)):]); n < len(b); {
+		n += copy(b[n:], lorem)
+	}
+}
+
+// Ticks content is a JSON array of market-data ticks whose prices follow a
+// random walk, padded with spaces to the payload size. Payloads too small
+// for a single tick hold an empty array, and below two bytes only spaces.
+type Ticks struct {
+	rand   *rand.Rand
+	prices []int64 // by symbol, in cents
+	buf    []byte
+}
+
+var symbols = []string{"AAPL", "MSFT", "NVDA", "AMZN", "GOOG", "META", "TSLA", "JPM", "XOM", "BRK.B"}
+
+func NewTicks(prng *rand.Rand) *Ticks {
+	t := &Ticks{rand: prng, prices: make([]int64, len(symbols))}
+	for i := range t.prices {
+		t.prices[i] = 5000 + prng.Int63n(45000)
+	}
+	return t
+}
+
+func (t *Ticks) Fill(b []byte) {
+	n := 0
+	if len(b) >= 2 {
+		b[0] = '['
+		n = 1
+		for {
+			sep := 1
+			if n == 1 {
+				sep = 0
+			}
+
+			// Room for the tick and the closing bracket.
+			t.buf = t.appendTick(t.buf[:0])
+			if n+sep+len(t.buf)+1 > len(b) {
+				break
+			}
+
+			if sep > 0 {
+				b[n] = ','
+			}
+			n += sep + copy(b[n+sep:], t.buf)
+		}
+		b[n] = ']'
+		n++
+	}
+
+	for i := n; i < len(b); i++ {
+		b[i] = ' '
+	}
+}
+
+func (t *Ticks) appendTick(dst []byte) []byte {
+	i := t.rand.Intn(len(symbols))
+	t.prices[i] = max(t.prices[i]+t.rand.Int63n(21)-10, 1)
+	bid := t.prices[i]
+	ask := bid + 1 + t.rand.Int63n(5)
+
+	dst = append(dst, `{"symbol":"`...)
+	dst = append(dst, symbols[i]...)
+	dst = append(dst, `","bid":`...)
+	dst = appendCents(dst, bid)
+	dst = append(dst, `,"ask":`...)
+	dst = appendCents(dst, ask)
+	dst = append(dst, `,"bid_size":`...)
+	dst = strconv.AppendInt(dst, 100*(1+t.rand.Int63n(50)), 10)
+	dst = append(dst, `,"ask_size":`...)
+	dst = strconv.AppendInt(dst, 100*(1+t.rand.Int63n(50)), 10)
+	dst = append(dst, `,"ts":`...)
+	dst = strconv.AppendInt(dst, time.Now().UnixNano(), 10)
+	return append(dst, '}')
+}
+
+func appendCents(dst []byte, cents int64) []byte {
+	dst = strconv.AppendInt(dst, cents/100, 10)
+	dst = append(dst, '.', byte('0'+cents/10%10), byte('0'+cents%10))
+	return dst
+}
@@ -0,0 +1,94 @@
+// Package payload generates the message payloads of senders. A Generator
+// pairs a size distribution with a kind of content, so both the size and
+// the compressibility of messages can be varied.
+package payload
+
+import (
+	"bytes"
+	"go-relay/capture"
+	"go-relay/cmd/conf"
+	"math/rand"
+)
+
+// Generator produces payloads.
+type Generator interface {
+	// Next returns a new payload, which the caller may keep.
+	Next() []byte
+}
+
+// New returns a generator drawing sizes from size and filling them with
+// content.
+func New(size Size, content Content) Generator {
+	return &generator{size: size, content: content}
+}
+
+// FromConfig returns the generator for the payload settings of cfg, seeded
+// with its rand seed, or one replaying the payloads of replay if there are
+// any.
+func FromConfig(cfg *conf.Config, replay []capture.Record) Generator {
+	if len(replay) > 0 {
+		return &Replay{Records: replay}
+	}
+
+	prng := rand.New(rand.NewSource(cfg.RandSeed))
+
+	var size Size
+	switch cfg.PayloadSize {
+	case "fixed":
+		size = Fixed(cfg.PayloadBytes)
+	case "uniform":
+		size = &Uniform{Min: cfg.PayloadMinBytes, Max: cfg.PayloadMaxBytes, Rand: prng}
+	case "lognormal":
+		size = &LogNormal{
+			Median: cfg.PayloadBytes,
+			Sigma:  cfg.PayloadSigma,
+			Min:    cfg.PayloadMinBytes,
+			Max:    cfg.PayloadMaxBytes,
+			Rand:   prng,
+		}
+	case "bimodal":
+		size = &Bimodal{
+			Small:         cfg.PayloadMinBytes,
+			Large:         cfg.PayloadMaxBytes,
+			LargeFraction: cfg.PayloadLargeFraction,
+			Rand:          prng,
+		}
+	}
+
+	var content Content
+	switch cfg.PayloadContent {
+	case "random":
+		content = Random{Rand: prng}
+	case "zeros":
+		content = Zeros{}
+	case "text":
+		content = &Text{Rand: prng}
+	case "json":
+		content = NewTicks(prng)
+	}
+
+	return New(size, content)
+}
+
+// Replay cycles through the payloads of captured messages.
+type Replay struct {
+	Records []capture.Record
+	next    int
+}
+
+func (r *Replay) Next() []byte {
+	b := bytes.Clone(r.Records[r.next].Payload())
+	r.next = (r.next + 1) % len(r.Records)
+	return b
+}
+
+type generator struct {
+	size    Size
+	content Content
+}
+
+func (g *generator) Next() []byte {
+	b := make([]byte, g.size.Next())
+	g.content.Fill(b)
+	return b
+}
@@ -0,0 +1,168 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/json"
+	"go-relay/cmd/conf"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+func TestSizeBounds(t *testing.T) {
+	const n = 100_000
+
+	tests := []struct {
+		name     string
+		size     func(prng *rand.Rand) Size
+		min, max int // inclusive
+	}{
+		{
+			name: "fixed",
+			size: func(*rand.Rand) Size { return Fixed(300) },
+			min:  300, max: 300,
+		},
+		{
+			name: "uniform",
+			size: func(prng *rand.Rand) Size { return &Uniform{Min: 10, Max: 20, Rand: prng} },
+			min:  10, max: 19,
+		},
+		{
+			name: "uniform without range",
+			size: func(prng *rand.Rand) Size { return &Uniform{Min: 64, Max: 64, Rand: prng} },
+			min:  64, max: 64,
+		},
+		{
+			name: "lognormal",
+			size: func(prng *rand.Rand) Size {
+				return &LogNormal{Median: 256, Sigma: 2, Min: 16, Max: 4096, Rand: prng}
+			},
+			min: 16, max: 4096,
+		},
+		{
+			name: "lognormal narrow",
+			size: func(prng *rand.Rand) Size {
+				return &LogNormal{Median: 256, Sigma: 0.1, Min: 200, Max: 300, Rand: prng}
+			},
+			min: 200, max: 300,
+		},
+		{
+			name: "bimodal",
+			size: func(prng *rand.Rand) Size {
+				return &Bimodal{Small: 100, Large: 10_000, LargeFraction: 0.1, Rand: prng}
+			},
+			min: 100, max: 10_000,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			size := tt.size(rand.New(rand.NewSource(1)))
+
+			seen := map[int]int{}
+			for range n {
+				v := size.Next()
+				if v < tt.min || v > tt.max {
+					t.Fatalf("size %v outside [%v, %v]", v, tt.min, tt.max)
+				}
+				seen[v]++
+			}
+
+			switch s := size.(type) {
+			case *Uniform:
+				if s.Max > s.Min && len(seen) != s.Max-s.Min {
+					t.Errorf("drew %v distinct sizes, want all %v", len(seen), s.Max-s.Min)
+				}
+			case *LogNormal:
+				// Half the sizes fall below the median.
+				below := 0
+				for v, c := range seen {
+					if v < s.Median {
+						below += c
+					}
+				}
+				if f := float64(below) / n; f < 0.48 || f > 0.52 {
+					t.Errorf("%.3f of sizes below the median", f)
+				}
+			case *Bimodal:
+				if len(seen) != 2 {
+					t.Errorf("drew sizes %v, want only small and large", seen)
+				}
+				if f := float64(seen[s.Large]) / n; f < 0.09 || f > 0.11 {
+					t.Errorf("%.3f of sizes large, want %v", f, s.LargeFraction)
+				}
+			}
+		})
+	}
+}
+
+func TestTicks(t *testing.T) {
+	ticks := NewTicks(rand.New(rand.NewSource(1)))
+
+	type tick struct {
+		Symbol  string  `json:"symbol"`
+		Bid     float64 `json:"bid"`
+		Ask     float64 `json:"ask"`
+		BidSize int     `json:"bid_size"`
+		AskSize int     `json:"ask_size"`
+		TS      int64   `json:"ts"`
+	}
+
+	for _, size := range []int{2, 3, 10, 100, 130, 150, 300, 1000, 4096, 65536} {
+		b := bytes.Repeat([]byte{'x'}, size)
+		ticks.Fill(b)
+
+		var got []tick
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%v bytes: %v: %q", size, err, b)
+		}
+		for _, tk := range got {
+			if !slices.Contains(symbols, tk.Symbol) || tk.Bid <= 0 || tk.Ask <= tk.Bid || tk.TS == 0 {
+				t.Errorf("%v bytes: bad tick %+v", size, tk)
+			}
+		}
+
+		// Padding is spaces after the array, shorter than another tick.
+		end := bytes.LastIndexByte(b, ']') + 1
+		if pad := b[end:]; len(bytes.Trim(pad, " ")) != 0 {
+			t.Errorf("%v bytes: padded with %q", size, pad)
+		}
+		if size >= 1000 && size-end > 200 {
+			t.Errorf("%v bytes: %v bytes of padding", size, size-end)
+		}
+	}
+
+	// Too small for an array.
+	for _, size := range []int{0, 1} {
+		b := bytes.Repeat([]byte{'x'}, size)
+		ticks.Fill(b)
+		if len(bytes.Trim(b, " ")) != 0 {
+			t.Errorf("%v bytes: %q, want spaces", size, b)
+		}
+	}
+}
+
+func TestGeneratorSize(t *testing.T) {
+	prng := rand.New(rand.NewSource(1))
+	contents := []Content{Random{Rand: prng}, Zeros{}, &Text{Rand: prng}, NewTicks(prng)}
+
+	for _, content := range contents {
+		for _, size := range []int{0, 1, 17, 4096} {
+			if b := New(Fixed(size), content).Next(); len(b) != size {
+				t.Errorf("%T: %v bytes, want %v", content, len(b), size)
+			}
+		}
+	}
+}
+
+func TestFromConfigSeeded(t *testing.T) {
+	cfg := conf.Default()
+	cfg.PayloadSize, cfg.PayloadContent = "lognormal", "text"
+
+	a, b := FromConfig(cfg, nil), FromConfig(cfg, nil)
+	for i := range 100 {
+		if x, y := a.Next(), b.Next(); !bytes.Equal(x, y) {
+			t.Fatalf("payload %v differs with the same seed", i)
+		}
+	}
+}
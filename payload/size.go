@@ -0,0 +1,61 @@
+package payload
+
+import (
+	"math"
+	"math/rand"
+)
+
+// Size draws payload sizes in bytes.
+type Size interface {
+	Next() int
+}
+
+// Fixed is always the same size.
+type Fixed int
+
+func (f Fixed) Next() int {
+	return int(f)
+}
+
+// Uniform sizes are spread evenly over [Min, Max).
+type Uniform struct {
+	Min, Max int
+	Rand     *rand.Rand
+}
+
+func (u *Uniform) Next() int {
+	if u.Max <= u.Min {
+		return u.Min
+	}
+	return u.Rand.Intn(u.Max-u.Min) + u.Min
+}
+
+// LogNormal sizes cluster around Median with a long tail of large ones, as
+// in most real traffic. Sigma is the standard deviation of their logarithm;
+// sizes are clamped to [Min, Max].
+type LogNormal struct {
+	Median   int
+	Sigma    float64
+	Min, Max int
+	Rand     *rand.Rand
+}
+
+func (l *LogNormal) Next() int {
+	n := int(float64(l.Median) * math.Exp(l.Rand.NormFloat64()*l.Sigma))
+	return min(max(n, l.Min), l.Max)
+}
+
+// Bimodal sizes are either Small or, with probability LargeFraction, Large,
+// like frequent updates mixed with occasional snapshots.
+type Bimodal struct {
+	Small, Large  int
+	LargeFraction float64
+	Rand          *rand.Rand
+}
+
+func (b *Bimodal) Next() int {
+	if b.Rand.Float64() < b.LargeFraction {
+		return b.Large
+	}
+	return b.Small
+}
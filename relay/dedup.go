@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"go-relay/envelope"
+	"sync"
+)
+
+// dedup passes on the first copy of each message read from redundant
+// upstreams. It remembers the last window messages, so a copy arriving
+// later than that is passed on again.
+type dedup struct {
+	mu    sync.Mutex
+	seen  map[dedupKey]int64 // arrival of the first copy, unix ns
+	order []dedupKey         // ring of the keys in seen
+	next  int                // oldest key in order once it is full
+}
+
+type dedupKey struct {
+	senderID uint32
+	topic    string
+	seq      uint64
+}
+
+func newDedup(window int) *dedup {
+	return &dedup{
+		seen:  make(map[dedupKey]int64, window),
+		order: make([]dedupKey, 0, window),
+	}
+}
+
+// first reports whether msg, arriving at now, is the first copy of its
+// message. Messages that are not envelopes always are.
+func (d *dedup) first(msg []byte, now int64) bool {
+	e, err := envelope.Decode(msg)
+	if err != nil {
+		return true
+	}
+	key := dedupKey{senderID: e.SenderID, topic: e.Topic, seq: e.Seq}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if at, ok := d.seen[key]; ok {
+		duplicates.Inc()
+		duplicateLag.Observe(float64(now-at) / 1e9)
+		return false
+	}
+
+	if len(d.order) < cap(d.order) {
+		d.order = append(d.order, key)
+	} else {
+		delete(d.seen, d.order[d.next])
+		d.order[d.next] = key
+		d.next = (d.next + 1) % len(d.order)
+	}
+	d.seen[key] = now
+	return true
+}
@@ -0,0 +1,166 @@
+package relay
+
+import (
+	"crypto/tls"
+	"go-relay/tlsconf"
+	"sync"
+
+	"github.com/Allenxuxu/gev"
+	"github.com/Allenxuxu/gev/plugins/websocket"
+	"github.com/Allenxuxu/gev/plugins/websocket/ws"
+	"github.com/Allenxuxu/gev/plugins/websocket/ws/util"
+)
+
+// GevDownstream serves subscribers from github.com/Allenxuxu/gev epoll loops.
+// gev cannot speak TLS, so with a TLS config the loops serve a loopback
+// address behind a tlsconf.Front.
+type GevDownstream struct {
+	Addr      string
+	Path      string
+	NumLoops  int
+	TLSConfig *tls.Config // nil serves plain ws://
+
+	mu     sync.Mutex
+	server *gev.Server
+	front  *tlsconf.Front
+	closed bool
+}
+
+func NewGevDownstream(addr, path string, numLoops int) *GevDownstream {
+	return &GevDownstream{
+		Addr:     addr,
+		Path:     path,
+		NumLoops: numLoops,
+	}
+}
+
+func (d *GevDownstream) Serve(h Handler) error {
+	u := &ws.Upgrader{}
+	u.OnRequest = func(c *gev.Connection, uri []byte) error {
+		c.Set(gevURIKey, string(uri))
+		return nil
+	}
+
+	handler := &gevDownstreamHandler{
+		h:    h,
+		path: d.Path,
+		subs: make(map[*gev.Connection]*gevSubscriber),
+	}
+
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	opts := []gev.Option{
+		gev.CustomProtocol(websocket.New(u)),
+		gev.Network("tcp"),
+		gev.Address(d.Addr),
+		gev.NumLoops(d.NumLoops),
+	}
+	if d.TLSConfig != nil {
+		front, err := tlsconf.Listen(d.Addr, d.TLSConfig)
+		if err != nil {
+			d.mu.Unlock()
+			return err
+		}
+		d.front = front
+		handler.front = front
+		opts = append(opts, gev.Address(front.Backend))
+	}
+	server, err := gev.NewServer(websocket.NewHandlerWrap(u, handler), opts...)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	d.server = server
+	d.mu.Unlock()
+
+	server.Start()
+	return nil
+}
+
+func (d *GevDownstream) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	if d.front != nil {
+		_ = d.front.Close()
+	}
+	if d.server != nil {
+		d.server.Stop()
+	}
+	return nil
+}
+
+const gevURIKey = "uri"
+
+type gevDownstreamHandler struct {
+	h     Handler
+	path  string
+	front *tlsconf.Front // nil without TLS
+
+	mu   sync.Mutex
+	subs map[*gev.Connection]*gevSubscriber
+}
+
+// OnConnect closes connections that skipped the TLS front.
+func (g *gevDownstreamHandler) OnConnect(c *gev.Connection) {
+	if g.front != nil && !g.front.Forwarded(c.PeerAddr()) {
+		_ = c.Close()
+	}
+}
+
+// OnMessage subscribes a connection on its first frame: OnConnect fires
+// before the websocket upgrade, when writing frames would corrupt the
+// handshake response.
+func (g *gevDownstreamHandler) OnMessage(c *gev.Connection, data []byte) (ws.MessageType, []byte) {
+	g.mu.Lock()
+	sub, ok := g.subs[c]
+	if !ok {
+		sub = &gevSubscriber{conn: c}
+		g.subs[c] = sub
+	}
+	g.mu.Unlock()
+
+	if !ok {
+		uri, _ := c.Get(gevURIKey)
+		s, _ := uri.(string)
+		g.h.Subscribe(sub, pathTopics(g.path, s)...)
+	}
+	g.h.Control(sub, data)
+
+	return ws.MessageBinary, nil
+}
+
+func (g *gevDownstreamHandler) OnClose(c *gev.Connection) {
+	g.mu.Lock()
+	sub, ok := g.subs[c]
+	delete(g.subs, c)
+	g.mu.Unlock()
+
+	if ok {
+		g.h.Unsubscribe(sub)
+	}
+}
+
+type gevSubscriber struct {
+	conn *gev.Connection
+}
+
+func (s *gevSubscriber) WriteMessage(msg []byte) error {
+	frame, err := util.PackData(ws.MessageBinary, msg)
+	if err != nil {
+		return err
+	}
+	return s.conn.Send(frame)
+}
+
+// Close sends a close frame before closing the connection.
+func (s *gevSubscriber) Close() error {
+	if frame, err := util.PackCloseData(""); err == nil {
+		_ = s.conn.Send(frame)
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,129 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// GorillaUpstream reads from a sender with github.com/gorilla/websocket.
+type GorillaUpstream struct {
+	URL       string
+	Dialer    *websocket.Dialer
+	TLSConfig *tls.Config // for wss:// URLs, overrides the dialer's
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func NewGorillaUpstream(url string) *GorillaUpstream {
+	return &GorillaUpstream{
+		URL:    url,
+		Dialer: websocket.DefaultDialer,
+	}
+}
+
+func (u *GorillaUpstream) Dial(ctx context.Context) error {
+	dialer := u.Dialer
+	if u.TLSConfig != nil {
+		d := *dialer
+		d.TLSClientConfig = u.TLSConfig
+		dialer = &d
+	}
+
+	conn, _, err := dialer.DialContext(ctx, u.URL, nil)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.conn = conn
+	u.mu.Unlock()
+
+	return conn.WriteMessage(websocket.TextMessage, []byte("ready"))
+}
+
+// ReadMessage must not be called concurrently with Dial.
+func (u *GorillaUpstream) ReadMessage() ([]byte, error) {
+	_, msg, err := u.conn.ReadMessage()
+	return msg, err
+}
+
+// Close sends a close frame before closing the connection.
+func (u *GorillaUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == nil {
+		return nil
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = u.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+	return u.conn.Close()
+}
+
+// GorillaDownstream serves subscribers with github.com/gorilla/websocket.
+type GorillaDownstream struct {
+	Addr      string
+	Path      string
+	Upgrader  websocket.Upgrader
+	TLSConfig *tls.Config // nil serves plain ws://
+
+	srv httpServer
+}
+
+func NewGorillaDownstream(addr, path string) *GorillaDownstream {
+	return &GorillaDownstream{
+		Addr: addr,
+		Path: path,
+	}
+}
+
+func (d *GorillaDownstream) Serve(h Handler) error {
+	mux := http.NewServeMux()
+	handleTopics(mux, d.Path, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := d.Upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		sub := &gorillaSubscriber{conn: conn}
+		h.Subscribe(sub, pathTopics(d.Path, r.URL.Path)...)
+		defer h.Unsubscribe(sub)
+
+		// Keep reading so control messages are handled and a disconnect
+		// is noticed.
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			h.Control(sub, msg)
+		}
+	})
+
+	return d.srv.serve(d.Addr, mux, d.TLSConfig)
+}
+
+func (d *GorillaDownstream) Close() error {
+	return d.srv.close()
+}
+
+type gorillaSubscriber struct {
+	conn *websocket.Conn
+}
+
+func (s *gorillaSubscriber) WriteMessage(msg []byte) error {
+	return s.conn.WriteMessage(websocket.BinaryMessage, msg)
+}
+
+// Close sends a close frame before closing the connection.
+func (s *gorillaSubscriber) Close() error {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = s.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeTimeout))
+	return s.conn.Close()
+}
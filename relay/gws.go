@@ -0,0 +1,226 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/lxzan/gws"
+)
+
+const (
+	gwsSubscriberKey = "subscriber"
+	gwsTopicsKey     = "topics"
+)
+
+// GWSUpstream reads from a sender with github.com/lxzan/gws.
+type GWSUpstream struct {
+	Addr      string
+	Option    gws.ClientOption
+	TLSConfig *tls.Config // for wss:// addresses, overrides the option's
+
+	mu   sync.Mutex
+	conn *gwsUpstreamConn
+}
+
+func NewGWSUpstream(addr string) *GWSUpstream {
+	return &GWSUpstream{
+		Addr: addr,
+		Option: gws.ClientOption{
+			PermessageDeflate: gws.PermessageDeflate{
+				Enabled:               true,
+				ServerContextTakeover: true,
+				ClientContextTakeover: true,
+			},
+		},
+	}
+}
+
+func (u *GWSUpstream) Dial(ctx context.Context) error {
+	option := u.Option
+	option.Addr = u.Addr
+	if u.TLSConfig != nil {
+		// gws fills in the server name of the config it is given.
+		option.TlsConfig = u.TLSConfig.Clone()
+	}
+
+	c := &gwsUpstreamConn{
+		messageChan: make(chan []byte),
+		done:        make(chan struct{}),
+	}
+	socket, _, err := gws.NewClient(c, &option)
+	if err != nil {
+		return err
+	}
+	c.socket = socket
+
+	u.mu.Lock()
+	u.conn = c
+	u.mu.Unlock()
+
+	go socket.ReadLoop()
+
+	return socket.WriteString("ready")
+}
+
+// ReadMessage must not be called concurrently with Dial.
+func (u *GWSUpstream) ReadMessage() ([]byte, error) {
+	c := u.conn
+	select {
+	case msg := <-c.messageChan:
+		return msg, nil
+	case <-c.done:
+		return nil, c.err
+	}
+}
+
+// Close sends a close frame, which also closes the connection.
+func (u *GWSUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == nil {
+		return nil
+	}
+	err := u.conn.socket.WriteClose(1000, nil)
+	if errors.Is(err, gws.ErrConnClosed) {
+		return nil
+	}
+	return err
+}
+
+// gwsUpstreamConn receives the events of one connection of a GWSUpstream.
+type gwsUpstreamConn struct {
+	socket      *gws.Conn
+	messageChan chan []byte
+	done        chan struct{}
+	closeOnce   sync.Once
+	err         error
+}
+
+func (c *gwsUpstreamConn) OnOpen(socket *gws.Conn) {}
+
+func (c *gwsUpstreamConn) OnClose(socket *gws.Conn, err error) {
+	c.closeOnce.Do(func() {
+		if err == nil {
+			err = errors.New("upstream closed")
+		}
+		c.err = err
+		close(c.done)
+	})
+}
+
+func (c *gwsUpstreamConn) OnPing(socket *gws.Conn, payload []byte) {
+	_ = socket.WritePong(payload)
+}
+
+func (c *gwsUpstreamConn) OnPong(socket *gws.Conn, payload []byte) {}
+
+func (c *gwsUpstreamConn) OnMessage(socket *gws.Conn, message *gws.Message) {
+	defer message.Close()
+
+	// The message buffer returns to a pool on Close, so copy it out.
+	msg := append([]byte(nil), message.Data.Bytes()...)
+
+	select {
+	case c.messageChan <- msg:
+	case <-c.done:
+	}
+}
+
+// GWSDownstream serves subscribers with github.com/lxzan/gws.
+type GWSDownstream struct {
+	Addr      string
+	Path      string
+	Option    gws.ServerOption
+	TLSConfig *tls.Config // nil serves plain ws://
+
+	srv httpServer
+}
+
+func NewGWSDownstream(addr, path string) *GWSDownstream {
+	return &GWSDownstream{
+		Addr: addr,
+		Path: path,
+		Option: gws.ServerOption{
+			ParallelEnabled:   true,                                 // Parallel message processing
+			Recovery:          gws.Recovery,                         // Exception recovery
+			PermessageDeflate: gws.PermessageDeflate{Enabled: true}, // Enable compression
+		},
+	}
+}
+
+func (d *GWSDownstream) Serve(h Handler) error {
+	option := d.Option
+	upgrader := gws.NewUpgrader(&gwsDownstreamHandler{h: h}, &option)
+
+	mux := http.NewServeMux()
+	handleTopics(mux, d.Path, func(writer http.ResponseWriter, request *http.Request) {
+		socket, err := upgrader.Upgrade(writer, request)
+		if err != nil {
+			return
+		}
+		socket.Session().Store(gwsTopicsKey, pathTopics(d.Path, request.URL.Path))
+
+		go func() {
+			socket.ReadLoop() // Blocking prevents the context from being GC.
+		}()
+	})
+
+	return d.srv.serve(d.Addr, mux, d.TLSConfig)
+}
+
+func (d *GWSDownstream) Close() error {
+	return d.srv.close()
+}
+
+type gwsDownstreamHandler struct {
+	h Handler
+}
+
+func (g *gwsDownstreamHandler) OnOpen(socket *gws.Conn) {
+	sub := &gwsSubscriber{conn: socket}
+	socket.Session().Store(gwsSubscriberKey, sub)
+
+	topics, _ := socket.Session().Load(gwsTopicsKey)
+	g.h.Subscribe(sub, topics.([]string)...)
+}
+
+func (g *gwsDownstreamHandler) OnClose(socket *gws.Conn, err error) {
+	if sub, ok := socket.Session().Load(gwsSubscriberKey); ok {
+		g.h.Unsubscribe(sub.(*gwsSubscriber))
+	}
+}
+
+func (g *gwsDownstreamHandler) OnPing(socket *gws.Conn, payload []byte) {
+	_ = socket.WritePong(payload)
+}
+
+func (g *gwsDownstreamHandler) OnPong(socket *gws.Conn, payload []byte) {}
+
+func (g *gwsDownstreamHandler) OnMessage(socket *gws.Conn, message *gws.Message) {
+	defer message.Close()
+
+	if sub, ok := socket.Session().Load(gwsSubscriberKey); ok {
+		g.h.Control(sub.(*gwsSubscriber), message.Bytes())
+	}
+}
+
+type gwsSubscriber struct {
+	conn *gws.Conn
+}
+
+func (s *gwsSubscriber) WriteMessage(msg []byte) error {
+	return s.conn.WriteMessage(gws.OpcodeBinary, msg)
+}
+
+// Close sends a close frame, which also closes the connection.
+func (s *gwsSubscriber) Close() error {
+	err := s.conn.WriteClose(1000, nil)
+	if errors.Is(err, gws.ErrConnClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// closeTimeout bounds writing a close frame.
+const closeTimeout = time.Second
+
+// handleTopics serves h at path and below it, where the rest of the path
+// names a topic.
+func handleTopics(mux *http.ServeMux, path string, h http.HandlerFunc) {
+	mux.HandleFunc(path, h)
+	if prefix := strings.TrimSuffix(path, "/") + "/"; prefix != path {
+		mux.HandleFunc(prefix, h)
+	}
+}
+
+// httpServer is an http.Server that may be closed before it starts serving.
+type httpServer struct {
+	mu     sync.Mutex
+	server *http.Server
+	closed bool
+}
+
+// serve listens on addr, with TLS when config is not nil.
+func (s *httpServer) serve(addr string, h http.Handler, config *tls.Config) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.server = &http.Server{Addr: addr, Handler: h, TLSConfig: config}
+	server := s.server
+	s.mu.Unlock()
+
+	var err error
+	if config != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (s *httpServer) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.server == nil {
+		return nil
+	}
+	return s.server.Close()
+}
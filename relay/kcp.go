@@ -0,0 +1,127 @@
+package relay
+
+import (
+	"context"
+	"go-relay/cmd/conf"
+	"go-relay/kcpconn"
+	"sync"
+)
+
+// KCPUpstream reads from a sender over KCP.
+type KCPUpstream struct {
+	Addr string
+
+	cfg  *conf.Config
+	mu   sync.Mutex
+	conn *kcpconn.Conn
+}
+
+func NewKCPUpstream(addr string, cfg *conf.Config) *KCPUpstream {
+	return &KCPUpstream{
+		Addr: addr,
+		cfg:  cfg,
+	}
+}
+
+func (u *KCPUpstream) Dial(ctx context.Context) error {
+	conn, err := kcpconn.Dial(u.Addr, u.cfg)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	u.conn = conn
+	u.mu.Unlock()
+
+	return conn.WriteMessage([]byte("ready"))
+}
+
+// ReadMessage must not be called concurrently with Dial.
+func (u *KCPUpstream) ReadMessage() ([]byte, error) {
+	return u.conn.ReadMessage()
+}
+
+func (u *KCPUpstream) Close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn == nil {
+		return nil
+	}
+	return u.conn.Close()
+}
+
+// KCPDownstream serves subscribers over KCP. A session becomes a
+// subscriber of every topic once its first message ("ready") arrives.
+type KCPDownstream struct {
+	Addr string
+
+	cfg    *conf.Config
+	mu     sync.Mutex
+	l      *kcpconn.Listener
+	closed bool
+}
+
+func NewKCPDownstream(addr string, cfg *conf.Config) *KCPDownstream {
+	return &KCPDownstream{
+		Addr: addr,
+		cfg:  cfg,
+	}
+}
+
+func (d *KCPDownstream) Serve(h Handler) error {
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		return nil
+	}
+	l, err := kcpconn.Listen(d.Addr, d.cfg)
+	if err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	d.l = l
+	d.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if d.closed {
+				return nil
+			}
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+
+			msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			h.Subscribe(conn)
+			defer h.Unsubscribe(conn)
+
+			for {
+				h.Control(conn, msg)
+
+				if msg, err = conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (d *KCPDownstream) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	if d.l == nil {
+		return nil
+	}
+	return d.l.Close()
+}
@@ -0,0 +1,210 @@
+package relay
+
+import (
+	"fmt"
+	"go-relay/envelope"
+	"sync"
+)
+
+// pushResult is what happened to a message offered to a full queue.
+type pushResult int
+
+const (
+	queued    pushResult = iota
+	dropped              // the message was dropped
+	evicted              // the oldest queued message was dropped for it
+	conflated            // it replaced a queued message with the same key
+	waited               // it was queued once there was room
+	gone                 // the queue was closed, the subscriber removed
+)
+
+// queue holds the messages waiting for one subscriber. push is only called
+// by the relay's forwardLoop, pop only by the subscriber's writer; close may
+// be called at any time, after which push drops messages and pop returns
+// what was queued before.
+type queue interface {
+	push(msg []byte) pushResult
+	pop() ([]byte, bool) // false once closed and empty
+	len() int
+	close()
+}
+
+func newQueue(policy string, size int, stop <-chan struct{}, done <-chan struct{}) queue {
+	if policy == "conflate" {
+		return &conflateQueue{
+			size:   size,
+			latest: make(map[string][]byte),
+			ready:  make(chan struct{}, 1),
+		}
+	}
+	return &chanQueue{
+		policy: policy,
+		ch:     make(chan []byte, size),
+		closed: make(chan struct{}),
+		stop:   stop,
+		done:   done,
+	}
+}
+
+// chanQueue implements every policy but conflate.
+type chanQueue struct {
+	policy string
+	ch     chan []byte
+
+	// Closed instead of ch, which push may still be sending to.
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// The block policy gives up waiting when the relay stops or the
+	// writer is done.
+	stop <-chan struct{}
+	done <-chan struct{}
+}
+
+func (q *chanQueue) push(msg []byte) pushResult {
+	select {
+	case <-q.closed:
+		return gone
+	default:
+	}
+
+	select {
+	case q.ch <- msg:
+		return queued
+	default:
+	}
+
+	switch q.policy {
+	case "drop-oldest":
+		result := queued
+		for {
+			select {
+			case <-q.ch:
+				result = evicted
+			default:
+			}
+			select {
+			case q.ch <- msg:
+				return result
+			default:
+			}
+		}
+	case "block":
+		select {
+		case q.ch <- msg:
+			return waited
+		case <-q.closed:
+			return gone
+		case <-q.stop:
+		case <-q.done:
+		}
+	}
+	return dropped
+}
+
+func (q *chanQueue) pop() ([]byte, bool) {
+	select {
+	case msg := <-q.ch:
+		return msg, true
+	case <-q.closed:
+	}
+
+	// Drain what was queued before close.
+	select {
+	case msg := <-q.ch:
+		return msg, true
+	default:
+		return nil, false
+	}
+}
+
+func (q *chanQueue) len() int { return len(q.ch) }
+func (q *chanQueue) close()   { q.closeOnce.Do(func() { close(q.closed) }) }
+
+// conflateQueue keeps only the latest message per topic and sender, in the
+// order their keys were first queued.
+type conflateQueue struct {
+	mu     sync.Mutex
+	size   int
+	keys   []string
+	latest map[string][]byte
+	closed bool
+
+	ready chan struct{}
+}
+
+// conflationKey is the topic and sender ID of msg. Messages that are not
+// envelopes share one key.
+func conflationKey(msg []byte) string {
+	id, ok := envelope.RawSenderID(msg)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s/%d", envelope.RawTopic(msg), id)
+}
+
+func (q *conflateQueue) push(msg []byte) pushResult {
+	key := conflationKey(msg)
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return gone
+	}
+	if _, ok := q.latest[key]; ok {
+		q.latest[key] = msg
+		q.mu.Unlock()
+		return conflated
+	}
+	if len(q.keys) >= q.size {
+		q.mu.Unlock()
+		return dropped
+	}
+	q.keys = append(q.keys, key)
+	q.latest[key] = msg
+	q.mu.Unlock()
+
+	q.signal()
+	return queued
+}
+
+func (q *conflateQueue) pop() ([]byte, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.keys) > 0 {
+			key := q.keys[0]
+			q.keys = q.keys[1:]
+			msg := q.latest[key]
+			delete(q.latest, key)
+			q.mu.Unlock()
+			return msg, true
+		}
+		closed := q.closed
+		q.mu.Unlock()
+
+		if closed {
+			return nil, false
+		}
+		<-q.ready
+	}
+}
+
+func (q *conflateQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.keys)
+}
+
+func (q *conflateQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.signal()
+}
+
+func (q *conflateQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,592 @@
+// Package relay forwards messages read from upstream connections to every
+// subscriber of a downstream listener. The transports are pluggable; gorilla,
+// gws, gev and KCP backends live alongside the core.
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-relay/cmd/conf"
+	"go-relay/envelope"
+	"go-relay/metrics"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upstream is the connection messages are read from.
+type Upstream interface {
+	// Dial connects to the source and announces the relay as ready. It is
+	// called again to reconnect after Dial or ReadMessage failed.
+	Dial(ctx context.Context) error
+
+	// ReadMessage blocks until the next message arrives.
+	ReadMessage() ([]byte, error)
+
+	Close() error
+}
+
+// Downstream accepts the subscribers messages are forwarded to.
+type Downstream interface {
+	// Serve accepts subscribers until Close is called.
+	Serve(h Handler) error
+
+	Close() error
+}
+
+// Subscriber is a single downstream connection.
+type Subscriber interface {
+	WriteMessage(msg []byte) error
+	Close() error
+}
+
+// Handler is notified by a Downstream as subscribers come and go.
+type Handler interface {
+	// Subscribe adds topics to s, or all topics when none are given.
+	Subscribe(s Subscriber, topics ...string)
+
+	// Unsubscribe drops s.
+	Unsubscribe(s Subscriber)
+
+	// Control handles a message s sent, see ParseControl.
+	Control(s Subscriber, msg []byte)
+}
+
+var (
+	receivedTotal  = metrics.NewCounter("relay_messages_received_total", "Messages read from the upstream.")
+	forwardedTotal = metrics.NewCounter("relay_messages_forwarded_total", "Messages written to subscribers.")
+	droppedTotal   = metrics.NewCounter(`relay_messages_dropped_total{reason="chan_full"}`, "Messages the relay dropped.")
+	queueDropped   = metrics.NewCounter(`relay_messages_dropped_total{reason="queue_full"}`, "Messages the relay dropped.")
+	evictedTotal   = metrics.NewCounter(`relay_messages_dropped_total{reason="evicted"}`, "Messages the relay dropped.")
+	conflatedTotal = metrics.NewCounter(`relay_messages_dropped_total{reason="conflated"}`, "Messages the relay dropped.")
+	blockSeconds   = metrics.NewHistogram("relay_subscriber_block_seconds", "Time the relay waited for room in a full subscriber queue.", metrics.LatencyBuckets)
+	slowClosed     = metrics.NewCounter("relay_slow_subscribers_disconnected_total", "Subscribers closed by the disconnect backpressure policy.")
+	writeErrors    = metrics.NewCounter("relay_subscriber_write_errors_total", "Failed writes, each closing its subscriber.")
+	subscribers    = metrics.NewGauge("relay_subscribers", "Connected subscribers.")
+	duplicates     = metrics.NewCounter(`relay_messages_dropped_total{reason="duplicate"}`, "Messages the relay dropped.")
+	duplicateLag   = metrics.NewHistogram("relay_upstream_duplicate_lag_seconds", "How long after the first copy of a message a later copy arrived.", metrics.LatencyBuckets)
+)
+
+// Relay forwards every upstream message to all current subscribers. Each
+// subscriber has its own bounded queue and writer; cfg.Backpressure decides
+// what happens when a slow subscriber's queue is full.
+type Relay struct {
+	// OnUpstreamEvent is called whenever an upstream changes state, from
+	// the goroutine reading it; with active failover calls may overlap. It
+	// logs the event if nil. Set it before Start.
+	OnUpstreamEvent func(UpstreamEvent)
+
+	cfg     *conf.Config
+	ups     []*upstream
+	feeds   []*feed
+	live    atomic.Int32 // feeds still reading
+	dedup   *dedup       // nil unless several feeds read the same messages
+	down    Downstream
+	backoff Backoff
+
+	messageChan chan []byte
+	readers     sync.WaitGroup
+	forwarded   chan struct{} // closed when forwardLoop returns
+	draining    chan struct{} // closed by Shutdown
+	drainOnce   sync.Once
+
+	mu     sync.Mutex
+	subs   map[Subscriber]*subscription
+	all    map[*subscription]struct{}            // subscribers of every topic
+	topics map[string]map[*subscription]struct{} // subscribers by topic
+
+	targets []*subscription // broadcast's copy of the subscribers
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns a relay reading from ups, which are redundant sources of the
+// same messages used as cfg.Failover says.
+func New(cfg *conf.Config, ups []Upstream, down Downstream) *Relay {
+	r := &Relay{
+		cfg:         cfg,
+		down:        down,
+		backoff:     Backoff{Min: cfg.ReconnectMin, Max: cfg.ReconnectMax},
+		messageChan: make(chan []byte, cfg.MessageChanSize),
+		forwarded:   make(chan struct{}),
+		draining:    make(chan struct{}),
+		subs:        make(map[Subscriber]*subscription),
+		all:         make(map[*subscription]struct{}),
+		topics:      make(map[string]map[*subscription]struct{}),
+	}
+
+	for i, up := range ups {
+		r.ups = append(r.ups, newUpstream(i, up))
+	}
+	if cfg.Failover == "active" && len(ups) > 1 {
+		for _, u := range r.ups {
+			r.feeds = append(r.feeds, &feed{ups: []*upstream{u}})
+		}
+		r.dedup = newDedup(cfg.DedupWindow)
+	} else {
+		r.feeds = []*feed{{ups: r.ups}}
+	}
+
+	return r
+}
+
+// running holds the started relays of the process, which the depth gauges
+// add up: a gauge per relay would be replaced by the next relay's.
+var running = struct {
+	sync.Mutex
+	relays map[*Relay]struct{}
+}{relays: make(map[*Relay]struct{})}
+
+func init() {
+	metrics.NewGaugeFunc("relay_message_chan_depth", "Messages waiting to be forwarded.", func() float64 {
+		return sumRunning(func(r *Relay) int { return len(r.messageChan) })
+	})
+	metrics.NewGaugeFunc("relay_subscriber_queue_depth", "Messages queued for all subscribers.", func() float64 {
+		return sumRunning((*Relay).queued)
+	})
+}
+
+func sumRunning(f func(r *Relay) int) float64 {
+	running.Lock()
+	defer running.Unlock()
+
+	n := 0
+	for r := range running.relays {
+		n += f(r)
+	}
+	return float64(n)
+}
+
+// queued returns how many messages the subscriber queues hold.
+func (r *Relay) queued() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	for _, sub := range r.subs {
+		n += sub.queue.len()
+	}
+	return n
+}
+
+// Start starts forwarding in the background. Without cfg.Reconnect it dials
+// the upstreams first and the relay runs until ctx is cancelled, Stop is
+// called or they fail; with it the upstreams are dialled, and redialled
+// whenever they are lost, with backoff until cfg.ReconnectAttempts attempts
+// in a row failed.
+func (r *Relay) Start(ctx context.Context) error {
+	r.ctx, r.cancel = context.WithCancel(ctx)
+
+	if len(r.ups) == 0 {
+		r.cancel()
+		return errors.New("no upstreams")
+	}
+
+	if !r.cfg.Reconnect {
+		for _, f := range r.feeds {
+			u := f.current()
+			r.setState(u, UpstreamEvent{State: UpstreamConnecting})
+			if err := u.Dial(r.ctx); err != nil {
+				r.cancel()
+				for _, u := range r.ups {
+					_ = u.Close()
+				}
+				return fmt.Errorf("dial upstream %v: %w", u.id, err)
+			}
+			r.setState(u, UpstreamEvent{State: UpstreamConnected})
+		}
+	}
+
+	running.Lock()
+	running.relays[r] = struct{}{}
+	running.Unlock()
+
+	r.live.Store(int32(len(r.feeds)))
+	r.wg.Add(3 + len(r.feeds))
+	r.readers.Add(len(r.feeds))
+	for _, f := range r.feeds {
+		go func() {
+			defer r.wg.Done()
+			defer r.readers.Done()
+			r.readLoop(f)
+		}()
+	}
+	go func() {
+		defer r.wg.Done()
+		r.forwardLoop()
+	}()
+	go func() {
+		defer r.wg.Done()
+		if err := r.down.Serve(r); err != nil {
+			log.Println("downstream:", err)
+			r.cancel()
+		}
+	}()
+	go func() {
+		defer r.wg.Done()
+		<-r.ctx.Done()
+		r.close()
+	}()
+
+	return nil
+}
+
+// Shutdown stops the relay gracefully: it stops reading the upstreams and
+// accepting subscribers, forwards the messages already read, lets every
+// subscriber's writer drain its queue and closes the subscribers, which
+// sends websocket close frames. When ctx is done first the rest is dropped
+// and ctx.Err is returned.
+func (r *Relay) Shutdown(ctx context.Context) error {
+	first := false
+	r.drainOnce.Do(func() {
+		close(r.draining)
+		first = true
+	})
+	defer r.Stop()
+	if !first {
+		return nil
+	}
+
+	for _, u := range r.ups {
+		_ = u.Close()
+	}
+
+	read := make(chan struct{})
+	go func() {
+		r.readers.Wait()
+		close(read)
+	}()
+	select {
+	case <-read:
+	case <-r.ctx.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Nothing sends to messageChan any more, so forwardLoop ends once it
+	// is empty.
+	close(r.messageChan)
+	select {
+	case <-r.forwarded:
+	case <-r.ctx.Done():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	r.mu.Lock()
+	subs := make([]*subscription, 0, len(r.subs))
+	for s, sub := range r.subs {
+		subs = append(subs, sub)
+		r.remove(s)
+	}
+	r.mu.Unlock()
+
+	// The writers drain the closed queues.
+	var err error
+	for _, sub := range subs {
+		select {
+		case <-sub.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		_ = sub.sub.Close()
+	}
+	return err
+}
+
+func (r *Relay) isDraining() bool {
+	select {
+	case <-r.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop shuts the relay down and waits for its goroutines to exit.
+func (r *Relay) Stop() {
+	r.cancel()
+	r.wg.Wait()
+}
+
+// Done is closed once the relay starts stopping.
+func (r *Relay) Done() <-chan struct{} {
+	return r.ctx.Done()
+}
+
+// Wait blocks until the relay has stopped.
+func (r *Relay) Wait() {
+	r.wg.Wait()
+}
+
+// subscription is a subscriber with its queue of messages to write.
+type subscription struct {
+	sub    Subscriber
+	queue  queue
+	done   chan struct{}       // closed when the writer stops
+	topics map[string]struct{} // nil for every topic
+	drops  int                 // consecutive drops, only used by forwardLoop
+
+	// Copy of the message being written, stamped with its egress. Queued
+	// messages are shared with the other subscribers.
+	stamped []byte
+}
+
+func (r *Relay) Subscribe(s Subscriber, topics ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sub, ok := r.subs[s]
+	if !ok {
+		if r.isDraining() {
+			go s.Close()
+			return
+		}
+
+		sub = &subscription{
+			sub:  s,
+			done: make(chan struct{}),
+		}
+		sub.queue = newQueue(r.cfg.Backpressure, r.cfg.SubscriberQueueSize, r.ctx.Done(), sub.done)
+		r.subs[s] = sub
+		r.all[sub] = struct{}{}
+		subscribers.Set(int64(len(r.subs)))
+
+		go r.writeLoop(sub)
+	}
+
+	if len(topics) == 0 {
+		r.clearTopics(sub)
+		sub.topics = nil
+		r.all[sub] = struct{}{}
+		return
+	}
+
+	if sub.topics == nil {
+		delete(r.all, sub)
+		sub.topics = make(map[string]struct{})
+	}
+	for _, topic := range topics {
+		sub.topics[topic] = struct{}{}
+
+		subs, ok := r.topics[topic]
+		if !ok {
+			subs = make(map[*subscription]struct{})
+			r.topics[topic] = subs
+		}
+		subs[sub] = struct{}{}
+	}
+}
+
+func (r *Relay) Unsubscribe(s Subscriber) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.remove(s)
+}
+
+// Control subscribes s to topics or unsubscribes it from them.
+func (r *Relay) Control(s Subscriber, msg []byte) {
+	subscribe, topics, ok := ParseControl(msg)
+	if !ok {
+		return
+	}
+	if subscribe {
+		r.Subscribe(s, topics...)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sub, ok := r.subs[s]
+	if !ok {
+		return
+	}
+	if len(topics) == 0 {
+		r.clearTopics(sub)
+		delete(r.all, sub)
+		sub.topics = map[string]struct{}{}
+		return
+	}
+	for _, topic := range topics {
+		r.leave(sub, topic)
+	}
+}
+
+// remove stops the writer of s and reports whether s was subscribed.
+// r.mu must be held.
+func (r *Relay) remove(s Subscriber) bool {
+	sub, ok := r.subs[s]
+	if !ok {
+		return false
+	}
+
+	r.clearTopics(sub)
+	delete(r.all, sub)
+	delete(r.subs, s)
+	sub.queue.close()
+	subscribers.Set(int64(len(r.subs)))
+	return true
+}
+
+// clearTopics removes sub from the index of each of its topics. r.mu must
+// be held.
+func (r *Relay) clearTopics(sub *subscription) {
+	for topic := range sub.topics {
+		r.leave(sub, topic)
+	}
+}
+
+func (r *Relay) leave(sub *subscription, topic string) {
+	delete(sub.topics, topic)
+
+	subs := r.topics[topic]
+	delete(subs, sub)
+	if len(subs) == 0 {
+		delete(r.topics, topic)
+	}
+}
+
+func (r *Relay) forwardLoop() {
+	if r.cfg.LockOSThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+
+	defer close(r.forwarded)
+
+	done := r.ctx.Done()
+	for {
+		select {
+		case msg, ok := <-r.messageChan:
+			if !ok {
+				return
+			}
+			r.broadcast(msg)
+		case <-done:
+			return
+		default:
+			if r.cfg.UseGosched {
+				runtime.Gosched()
+			}
+		}
+	}
+}
+
+// broadcast queues msg for the subscribers of its topic and of every topic.
+// The subscribers are copied under r.mu and pushed to without it, so a queue
+// blocking under the block policy does not hold up Subscribe, Unsubscribe
+// or metrics scrapes.
+func (r *Relay) broadcast(msg []byte) {
+	r.mu.Lock()
+	r.targets = r.targets[:0]
+	for sub := range r.all {
+		r.targets = append(r.targets, sub)
+	}
+	if topic := envelope.RawTopic(msg); len(topic) > 0 {
+		for sub := range r.topics[string(topic)] {
+			r.targets = append(r.targets, sub)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, sub := range r.targets {
+		r.enqueue(sub, msg)
+	}
+	clear(r.targets)
+}
+
+// enqueue queues msg for sub and accounts for the backpressure policy.
+func (r *Relay) enqueue(sub *subscription, msg []byte) {
+	var start time.Time
+	if r.cfg.Backpressure == "block" {
+		start = time.Now()
+	}
+
+	switch sub.queue.push(msg) {
+	case queued:
+		sub.drops = 0
+	case waited:
+		sub.drops = 0
+		blockSeconds.Observe(time.Since(start).Seconds())
+	case evicted:
+		evictedTotal.Inc()
+	case conflated:
+		conflatedTotal.Inc()
+	case dropped:
+		queueDropped.Inc()
+		sub.drops++
+		if r.cfg.Backpressure == "disconnect" && sub.drops >= r.cfg.DisconnectThreshold {
+			r.mu.Lock()
+			removed := r.remove(sub.sub)
+			r.mu.Unlock()
+
+			if removed {
+				slowClosed.Inc()
+				go sub.sub.Close()
+			}
+		}
+	case gone:
+	}
+}
+
+// writeLoop writes the queue of sub until it is removed or a write fails.
+func (r *Relay) writeLoop(sub *subscription) {
+	for {
+		msg, ok := sub.queue.pop()
+		if !ok {
+			close(sub.done)
+			return
+		}
+
+		if r.cfg.HopTimestamps {
+			sub.stamped = append(sub.stamped[:0], msg...)
+			envelope.SetEgress(sub.stamped, time.Now().UnixNano())
+			msg = sub.stamped
+		}
+
+		if err := sub.sub.WriteMessage(msg); err != nil {
+			// Release a broadcast blocked on the queue.
+			close(sub.done)
+
+			// Writes to a subscriber that already left are expected.
+			r.mu.Lock()
+			removed := r.remove(sub.sub)
+			r.mu.Unlock()
+
+			if removed {
+				writeErrors.Inc()
+				_ = sub.sub.Close()
+			}
+			return
+		}
+		forwardedTotal.Inc()
+	}
+}
+
+func (r *Relay) close() {
+	running.Lock()
+	delete(running.relays, r)
+	running.Unlock()
+
+	for _, u := range r.ups {
+		_ = u.Close()
+	}
+	_ = r.down.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for s := range r.subs {
+		r.remove(s)
+		_ = s.Close()
+	}
+}
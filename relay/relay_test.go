@@ -0,0 +1,428 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"go-relay/cmd/conf"
+	"go-relay/envelope"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTimeout = 2 * time.Second
+
+var errClosed = errors.New("closed")
+
+// fakeUpstream delivers the messages sent to msgs.
+type fakeUpstream struct {
+	msgs chan []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func newFakeUpstream() *fakeUpstream {
+	return &fakeUpstream{msgs: make(chan []byte, 64), done: make(chan struct{})}
+}
+
+func (u *fakeUpstream) Dial(ctx context.Context) error { return nil }
+
+func (u *fakeUpstream) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-u.msgs:
+		return msg, nil
+	case <-u.done:
+		return nil, errClosed
+	}
+}
+
+func (u *fakeUpstream) Close() error {
+	u.once.Do(func() { close(u.done) })
+	return nil
+}
+
+// fakeDownstream accepts no connections; tests subscribe directly.
+type fakeDownstream struct {
+	done chan struct{}
+	once sync.Once
+}
+
+func newFakeDownstream() *fakeDownstream {
+	return &fakeDownstream{done: make(chan struct{})}
+}
+
+func (d *fakeDownstream) Serve(h Handler) error {
+	<-d.done
+	return nil
+}
+
+func (d *fakeDownstream) Close() error {
+	d.once.Do(func() { close(d.done) })
+	return nil
+}
+
+// fakeSubscriber passes every message written to it on to got. Until
+// release is closed, writes block, after signalling writing once.
+type fakeSubscriber struct {
+	got     chan envelope.Header
+	release chan struct{}
+	writing chan struct{}
+	started sync.Once
+
+	done chan struct{}
+	once sync.Once
+}
+
+func newFakeSubscriber(blocked bool) *fakeSubscriber {
+	s := &fakeSubscriber{
+		got:     make(chan envelope.Header, 64),
+		release: make(chan struct{}),
+		writing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if !blocked {
+		close(s.release)
+	}
+	return s
+}
+
+func (s *fakeSubscriber) WriteMessage(msg []byte) error {
+	s.started.Do(func() { close(s.writing) })
+	select {
+	case <-s.release:
+	case <-s.done:
+		return errClosed
+	}
+
+	// Anything else is a marker, passed on as its topic.
+	h, err := envelope.DecodeHeader(msg)
+	if err != nil {
+		h = envelope.Header{Topic: string(msg)}
+	}
+	s.got <- h
+	return nil
+}
+
+func (s *fakeSubscriber) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *fakeSubscriber) closed() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// until returns the sequence numbers s received up to the first message of
+// topic, which is not included.
+func (s *fakeSubscriber) until(t *testing.T, topic string) []uint64 {
+	t.Helper()
+
+	var seqs []uint64
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case h := <-s.got:
+			if h.Topic == topic {
+				return seqs
+			}
+			seqs = append(seqs, h.Seq)
+		case <-timeout:
+			t.Fatalf("no %q message after %v, got %v", topic, testTimeout, seqs)
+			return nil
+		}
+	}
+}
+
+// next returns the next message s received.
+func (s *fakeSubscriber) next(t *testing.T) envelope.Header {
+	t.Helper()
+
+	select {
+	case h := <-s.got:
+		return h
+	case <-time.After(testTimeout):
+		t.Fatalf("no message after %v", testTimeout)
+		return envelope.Header{}
+	}
+}
+
+func message(topic string, senderID uint32, seq uint64) []byte {
+	return envelope.Encode(nil, envelope.Header{Seq: seq, SenderID: senderID, Topic: topic}, nil)
+}
+
+func testConfig() *conf.Config {
+	cfg := conf.Default()
+	cfg.Reconnect = false
+	return cfg
+}
+
+func startRelay(t *testing.T, cfg *conf.Config, ups ...Upstream) *Relay {
+	t.Helper()
+
+	r := New(cfg, ups, newFakeDownstream())
+	r.OnUpstreamEvent = func(UpstreamEvent) {}
+	if err := r.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Stop)
+	return r
+}
+
+func TestRelayFanOut(t *testing.T) {
+	type msg struct {
+		topic string
+		seq   uint64
+	}
+
+	tests := []struct {
+		name   string
+		topics [][]string // per subscriber, nil for every topic
+		msgs   []msg
+		want   [][]uint64 // per subscriber
+	}{
+		{
+			name:   "every topic",
+			topics: [][]string{nil, nil},
+			msgs:   []msg{{"a", 1}, {"b", 2}, {"", 3}},
+			want:   [][]uint64{{1, 2, 3}, {1, 2, 3}},
+		},
+		{
+			name:   "by topic",
+			topics: [][]string{{"a"}, {"b"}, {"a", "b"}, nil},
+			msgs:   []msg{{"a", 1}, {"b", 2}, {"a", 3}, {"c", 4}},
+			want:   [][]uint64{{1, 3}, {2}, {1, 2, 3}, {1, 2, 3, 4}},
+		},
+		{
+			name:   "untagged only to every topic",
+			topics: [][]string{{"a"}, nil},
+			msgs:   []msg{{"", 1}, {"", 2}},
+			want:   [][]uint64{nil, {1, 2}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := newFakeUpstream()
+			r := startRelay(t, testConfig(), up)
+
+			subs := make([]*fakeSubscriber, len(tt.topics))
+			for i, topics := range tt.topics {
+				subs[i] = newFakeSubscriber(false)
+				if topics != nil {
+					// Every subscriber sees the end marker.
+					topics = append(topics, "end")
+				}
+				r.Subscribe(subs[i], topics...)
+			}
+
+			for _, m := range tt.msgs {
+				up.msgs <- message(m.topic, 1, m.seq)
+			}
+			up.msgs <- message("end", 1, 0)
+
+			for i, sub := range subs {
+				if got := sub.until(t, "end"); !slices.Equal(got, tt.want[i]) {
+					t.Errorf("subscriber %v got %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRelayBackpressure(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []uint64 // received by the slow subscriber
+		closed bool     // the slow subscriber was disconnected
+	}{
+		{policy: "drop-newest", want: []uint64{1, 2, 3}},
+		{policy: "drop-oldest", want: []uint64{1, 4, 5}},
+		{policy: "conflate", want: []uint64{1, 5}},
+		{policy: "block", want: []uint64{1, 2, 3, 4, 5}},
+		{policy: "disconnect", closed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Backpressure = tt.policy
+			cfg.SubscriberQueueSize = 2
+			cfg.DisconnectThreshold = 2
+
+			up := newFakeUpstream()
+			r := startRelay(t, cfg, up)
+
+			// fast also gets the end marker, which is queued once every
+			// message before it was offered to slow.
+			slow, fast := newFakeSubscriber(true), newFakeSubscriber(false)
+			r.Subscribe(slow, "t")
+			r.Subscribe(fast, "t", "end")
+
+			// slow's writer holds 1 while 2 to 5 meet its queue of 2.
+			up.msgs <- message("t", 1, 1)
+			select {
+			case <-slow.writing:
+			case <-time.After(testTimeout):
+				t.Fatal("slow subscriber never written to")
+			}
+			fast.next(t)
+			for seq := uint64(2); seq <= 5; seq++ {
+				up.msgs <- message("t", 1, seq)
+				if tt.policy != "block" {
+					// Paced by fast, whose queue of 2 must not fill up.
+					fast.next(t)
+				}
+			}
+			up.msgs <- message("end", 1, 0)
+
+			var pending []uint64 // not yet read from fast
+			if tt.policy == "block" {
+				pending = []uint64{2, 3, 4, 5}
+
+				// The broadcast waiting for slow must not hold up
+				// subscribing.
+				subscribed := make(chan struct{})
+				go func() {
+					r.Subscribe(newFakeSubscriber(false), "t")
+					close(subscribed)
+				}()
+				select {
+				case <-subscribed:
+				case <-time.After(testTimeout):
+					t.Fatal("Subscribe blocked behind a full queue")
+				}
+				close(slow.release)
+			}
+			if got := fast.until(t, "end"); !slices.Equal(got, pending) {
+				t.Fatalf("fast subscriber got %v, want %v", got, pending)
+			}
+
+			if tt.closed {
+				if !slow.closed() {
+					t.Error("slow subscriber not disconnected")
+				}
+				return
+			}
+
+			if tt.policy != "block" {
+				close(slow.release)
+			}
+			var got []uint64
+			for range tt.want {
+				got = append(got, slow.next(t).Seq)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("slow subscriber got %v, want %v", got, tt.want)
+			}
+			select {
+			case h := <-slow.got:
+				t.Errorf("slow subscriber got extra message %v", h.Seq)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestRelayDedup(t *testing.T) {
+	type step struct {
+		up   int // upstream the message arrives on
+		seq  uint64
+		want bool // forwarded
+	}
+
+	tests := []struct {
+		name   string
+		window int
+		steps  []step
+	}{
+		{
+			name:   "first copy wins",
+			window: 16,
+			steps: []step{
+				{0, 1, true}, {1, 1, false},
+				{1, 2, true}, {0, 2, false},
+				{0, 3, true}, {0, 4, true}, {1, 3, false}, {1, 4, false},
+			},
+		},
+		{
+			name:   "gap filled by the other upstream",
+			window: 16,
+			steps:  []step{{0, 1, true}, {0, 3, true}, {1, 2, true}, {1, 3, false}},
+		},
+		{
+			name:   "copies older than the window pass",
+			window: 2,
+			steps:  []step{{0, 1, true}, {0, 2, true}, {0, 3, true}, {1, 1, true}, {1, 3, false}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.Failover = "active"
+			cfg.DedupWindow = tt.window
+
+			ups := []*fakeUpstream{newFakeUpstream(), newFakeUpstream()}
+			r := startRelay(t, cfg, ups[0], ups[1])
+
+			sub := newFakeSubscriber(false)
+			r.Subscribe(sub)
+
+			// Each step is followed on the same upstream by a marker that
+			// is not an envelope, so dedup neither drops nor remembers it.
+			for i, s := range tt.steps {
+				ups[s.up].msgs <- message("t", 1, s.seq)
+				ups[s.up].msgs <- []byte("end")
+
+				got := sub.until(t, "end")
+				if forwarded := slices.Equal(got, []uint64{s.seq}); forwarded != s.want || !s.want && len(got) > 0 {
+					t.Errorf("step %v: seq %v from upstream %v: got %v, want forwarded %v", i, s.seq, s.up, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRelayDepthGauges(t *testing.T) {
+	// Each relay holds two messages in a queue behind a blocked write.
+	start := func() *Relay {
+		up := newFakeUpstream()
+		r := startRelay(t, testConfig(), up)
+
+		sub := newFakeSubscriber(true)
+		t.Cleanup(func() { close(sub.release) })
+		r.Subscribe(sub)
+		for seq := uint64(1); seq <= 3; seq++ {
+			up.msgs <- message("", 1, seq)
+		}
+
+		deadline := time.Now().Add(testTimeout)
+		for r.queued() != 2 {
+			if time.Now().After(deadline) {
+				t.Fatalf("%v messages queued, want 2", r.queued())
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return r
+	}
+
+	a, b := start(), start()
+	if got := sumRunning((*Relay).queued); got != 4 {
+		t.Errorf("two relays report %v queued, want 4", got)
+	}
+
+	a.Stop()
+	if got := sumRunning((*Relay).queued); got != 2 {
+		t.Errorf("after a stopped, %v queued, want 2", got)
+	}
+	b.Stop()
+	if got := sumRunning((*Relay).queued); got != 0 {
+		t.Errorf("after both stopped, %v queued, want 0", got)
+	}
+}
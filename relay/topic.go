@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"strings"
+)
+
+// ParseControl parses a message a subscriber sent to the relay:
+//
+//	subscribe [topic,topic...]
+//	unsubscribe [topic,topic...]
+//
+// Without topics, subscribe selects every topic and unsubscribe leaves
+// them all; unsubscribing from a topic does not affect a subscription to
+// every topic. ok is false for anything else, such as "ready".
+func ParseControl(msg []byte) (subscribe bool, topics []string, ok bool) {
+	verb, arg, _ := strings.Cut(strings.TrimSpace(string(msg)), " ")
+
+	switch verb {
+	case "subscribe":
+		subscribe = true
+	case "unsubscribe":
+	default:
+		return false, nil, false
+	}
+
+	for _, topic := range strings.Split(arg, ",") {
+		if topic = strings.TrimSpace(topic); topic != "" {
+			topics = append(topics, topic)
+		}
+	}
+	return subscribe, topics, true
+}
+
+// SubscribeMessage is the control message subscribing to topics.
+func SubscribeMessage(topics []string) []byte {
+	return []byte("subscribe " + strings.Join(topics, ","))
+}
+
+// pathTopics returns the topic selected by a request path below base, e.g.
+// btc for /relay/btc under /relay, or none for base itself.
+func pathTopics(base, path string) []string {
+	path, _, _ = strings.Cut(path, "?")
+
+	topic, ok := strings.CutPrefix(path, strings.TrimSuffix(base, "/")+"/")
+	if !ok || topic == "" {
+		return nil
+	}
+	return []string{topic}
+}
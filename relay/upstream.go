@@ -0,0 +1,288 @@
+package relay
+
+import (
+	"fmt"
+	"go-relay/envelope"
+	"go-relay/metrics"
+	"log"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamState is where the upstream connection of a relay is.
+type UpstreamState int32
+
+const (
+	UpstreamConnecting   UpstreamState = iota // dialling
+	UpstreamConnected                         // reading messages
+	UpstreamDisconnected                      // the connection was lost
+	UpstreamBackoff                           // waiting to redial
+	UpstreamClosed                            // the relay stopped or gave up
+)
+
+func (s UpstreamState) String() string {
+	switch s {
+	case UpstreamConnecting:
+		return "connecting"
+	case UpstreamConnected:
+		return "connected"
+	case UpstreamDisconnected:
+		return "disconnected"
+	case UpstreamBackoff:
+		return "backoff"
+	case UpstreamClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// UpstreamEvent reports a change of UpstreamState.
+type UpstreamEvent struct {
+	Upstream int // index in the upstreams given to New
+	State    UpstreamState
+	Attempt  int           // failed attempts in a row, see Relay.Start
+	Delay    time.Duration // for UpstreamBackoff, until the next dial
+	Err      error         // why the connection or dial failed, if it did
+}
+
+// Backoff computes the delays between redials: Min, doubling up to Max, with
+// up to half of each delay taken off at random so relays restarting
+// together spread out.
+type Backoff struct {
+	Min, Max time.Duration
+}
+
+// Delay returns the wait before redial attempt n, counting from 0.
+func (b Backoff) Delay(n int) time.Duration {
+	d := float64(b.Min) * math.Pow(2, float64(n))
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	return time.Duration(d - d/2*rand.Float64())
+}
+
+// upstream is one Upstream of a relay with its state and metrics.
+type upstream struct {
+	Upstream
+	id int
+
+	state      atomic.Int32
+	connected  *metrics.Gauge
+	stateGauge *metrics.Gauge
+	reconnects *metrics.Counter
+	dialErrors *metrics.Counter
+	won        *metrics.Counter
+}
+
+func newUpstream(id int, up Upstream) *upstream {
+	label := fmt.Sprintf(`{upstream="%d"}`, id)
+	return &upstream{
+		Upstream:   up,
+		id:         id,
+		connected:  metrics.NewGauge("relay_upstream_connected"+label, "1 while the upstream is connected."),
+		stateGauge: metrics.NewGauge("relay_upstream_state"+label, "State of the upstream: 0 connecting, 1 connected, 2 disconnected, 3 backoff, 4 closed."),
+		reconnects: metrics.NewCounter("relay_upstream_reconnects_total"+label, "Times the upstream was connected after a connection was lost."),
+		dialErrors: metrics.NewCounter("relay_upstream_dial_errors_total"+label, "Failed dials of the upstream."),
+		won:        metrics.NewCounter("relay_upstream_messages_won_total"+label, "Messages forwarded from the upstream, as the first copy to arrive."),
+	}
+}
+
+// feed reads from one of its upstreams at a time and fails over to the
+// next when that one is lost.
+type feed struct {
+	ups      []*upstream
+	cur      atomic.Int32
+	lastRead atomic.Int64 // unix ns
+}
+
+func (f *feed) current() *upstream {
+	return f.ups[f.cur.Load()]
+}
+
+func (f *feed) next() {
+	f.cur.Store((f.cur.Load() + 1) % int32(len(f.ups)))
+}
+
+func (r *Relay) readLoop(f *feed) {
+	defer func() {
+		for _, u := range f.ups {
+			r.setState(u, UpstreamEvent{State: UpstreamClosed})
+		}
+		// The relay stops once no feed is left, unless it is draining.
+		if r.live.Add(-1) == 0 && !r.isDraining() {
+			r.cancel()
+		}
+	}()
+
+	// failed counts attempts in a row that failed to dial or gave a
+	// connection lost before it delivered anything, as UDP dials always
+	// succeed.
+	failed := 0
+	if r.cfg.Reconnect {
+		var ok bool
+		if failed, ok = r.redial(f, failed); !ok {
+			return
+		}
+	}
+
+	if r.cfg.UpstreamIdleTimeout > 0 {
+		go r.watchIdle(f)
+	}
+
+	for {
+		u := f.current()
+		f.lastRead.Store(time.Now().UnixNano())
+
+		msg, err := u.ReadMessage()
+		if err != nil {
+			_ = u.Close()
+			if r.ctx.Err() != nil || r.isDraining() {
+				return
+			}
+
+			r.setState(u, UpstreamEvent{State: UpstreamDisconnected, Attempt: failed, Err: err})
+			if !r.cfg.Reconnect {
+				return
+			}
+
+			// Fail over before redialling the upstream that was lost.
+			f.next()
+
+			var ok bool
+			if failed, ok = r.redial(f, failed); !ok {
+				return
+			}
+			f.current().reconnects.Inc()
+			continue
+		}
+
+		failed = 0
+		receivedTotal.Inc()
+		now := time.Now().UnixNano()
+
+		if r.dedup != nil && !r.dedup.first(msg, now) {
+			continue
+		}
+		u.won.Inc()
+
+		if r.cfg.HopTimestamps {
+			msg = envelope.AppendHop(msg, now)
+		}
+
+		// Blocking subscribers hold the upstream back too.
+		if r.cfg.Backpressure == "block" {
+			select {
+			case r.messageChan <- msg:
+			case <-r.ctx.Done():
+			}
+			continue
+		}
+
+		select {
+		case r.messageChan <- msg:
+		default:
+			droppedTotal.Inc()
+			fmt.Println("relay chan full")
+		}
+	}
+}
+
+// redial dials the upstreams of f in turn until one connects, backing off
+// once every upstream failed. It returns the failed attempts, counting the
+// new connection until it delivers, and false if the relay stopped or gave
+// up.
+func (r *Relay) redial(f *feed, failed int) (int, bool) {
+	var err error
+	for ; ; failed++ {
+		u := f.current()
+
+		if n := r.cfg.ReconnectAttempts; n > 0 && failed >= n {
+			log.Printf("upstream %v: giving up after %v failed attempts", u.id, failed)
+			return failed, false
+		}
+
+		if failed >= len(f.ups) {
+			delay := r.backoff.Delay(failed - len(f.ups))
+			r.setState(u, UpstreamEvent{State: UpstreamBackoff, Attempt: failed, Delay: delay, Err: err})
+
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-r.ctx.Done():
+				t.Stop()
+				return failed, false
+			case <-r.draining:
+				t.Stop()
+				return failed, false
+			}
+		}
+
+		r.setState(u, UpstreamEvent{State: UpstreamConnecting, Attempt: failed})
+		if err = u.Dial(r.ctx); err == nil {
+			// close or Shutdown may have run while dialling and missed this
+			// connection.
+			if r.ctx.Err() != nil || r.isDraining() {
+				_ = u.Close()
+				return failed, false
+			}
+			r.setState(u, UpstreamEvent{State: UpstreamConnected, Attempt: failed})
+			return failed + 1, true
+		}
+
+		u.dialErrors.Inc()
+		_ = u.Close()
+		if r.ctx.Err() != nil || r.isDraining() {
+			return failed, false
+		}
+		f.next()
+	}
+}
+
+// watchIdle closes the current upstream of f whenever nothing was read from
+// it for cfg.UpstreamIdleTimeout, so a silently dead source is redialled.
+func (r *Relay) watchIdle(f *feed) {
+	timeout := r.cfg.UpstreamIdleTimeout
+	t := time.NewTicker(timeout / 4)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			u := f.current()
+			if UpstreamState(u.state.Load()) == UpstreamConnected && now.Sub(time.Unix(0, f.lastRead.Load())) > timeout {
+				log.Printf("upstream %v: nothing read for %v", u.id, timeout)
+				_ = u.Close()
+			}
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Relay) setState(u *upstream, e UpstreamEvent) {
+	e.Upstream = u.id
+	u.state.Store(int32(e.State))
+	u.stateGauge.Set(int64(e.State))
+	if e.State == UpstreamConnected {
+		u.connected.Set(1)
+	} else {
+		u.connected.Set(0)
+	}
+
+	if r.OnUpstreamEvent != nil {
+		r.OnUpstreamEvent(e)
+		return
+	}
+	switch {
+	case e.State == UpstreamBackoff && e.Err != nil:
+		log.Printf("upstream %v: redialling in %v after %v failed attempts: %v", u.id, e.Delay.Round(time.Millisecond), e.Attempt, e.Err)
+	case e.State == UpstreamBackoff:
+		log.Printf("upstream %v: redialling in %v after %v failed attempts", u.id, e.Delay.Round(time.Millisecond), e.Attempt)
+	case e.Err != nil:
+		log.Printf("upstream %v: %v: %v", u.id, e.State, e.Err)
+	case e.State != UpstreamConnecting:
+		log.Printf("upstream %v: %v", u.id, e.State)
+	}
+}
@@ -0,0 +1,552 @@
+package stats
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"go-relay/clock"
+	"go-relay/cmd/conf"
+	"go-relay/echo"
+	"go-relay/envelope"
+	"go-relay/metrics"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	receivedTotal  = metrics.NewCounter("receiver_messages_received_total", "Messages read from the relay.")
+	droppedTotal   = metrics.NewCounter(`receiver_messages_dropped_total{reason="chan_full"}`, "Messages the receiver dropped.")
+	invalidTotal   = metrics.NewCounter(`receiver_messages_dropped_total{reason="invalid"}`, "Messages the receiver dropped.")
+	latencySecs    = metrics.NewHistogram("receiver_latency_seconds", "Latency of measured messages.", metrics.LatencyBuckets)
+	rttHalfSecs    = metrics.NewHistogram("receiver_rtt_half_seconds", "Half the round trips of echoed messages.", metrics.LatencyBuckets)
+	intendedSecs   = metrics.NewHistogram("receiver_intended_latency_seconds", "Latency of measured messages from their intended send time.", metrics.LatencyBuckets)
+	upstreamSecs   = metrics.NewHistogram("receiver_upstream_seconds", "Time from the sender to the first relay of stamped messages.", metrics.LatencyBuckets)
+	relaySecs      = metrics.NewHistogram("receiver_relay_seconds", "Time from the first relay ingress to the last relay egress of stamped messages.", metrics.LatencyBuckets)
+	downstreamSecs = metrics.NewHistogram("receiver_downstream_seconds", "Time from the last relay to the receiver of stamped messages.", metrics.LatencyBuckets)
+	hopSkewTotal   = metrics.NewCounter("receiver_hop_clock_mismatches_total", "Stamped messages left out of the upstream and downstream segments, as the relay's clock disagrees with the sender's.")
+	lostGauge      = metrics.NewGauge("receiver_messages_lost", "Sequence numbers missing so far.")
+	dupGauge       = metrics.NewGauge("receiver_messages_duplicated", "Messages received more than once so far.")
+	reorderGauge   = metrics.NewGauge("receiver_messages_reordered", "Messages received out of order so far.")
+)
+
+type arrival struct {
+	conn       int
+	msg        []byte
+	recvNanoTS int64
+}
+
+// Collector is the receiving end of every stack: it decodes envelopes,
+// records their latency and sequence numbers and prints a report each second.
+// Messages from open-loop senders are also measured from their intended send
+// time, which counts the time they waited behind a stall. With a sender clock
+// to probe, latencies are corrected by the estimated clock offset. With a
+// sender to echo messages to, half their round trips are reported too, which
+// need no clock sync. Messages stamped by relays are broken down into the
+// upstream wire, the time in the relay and the downstream wire; the wires
+// compare relay timestamps with the sender's clock, through an estimate of
+// the relay's clock when it serves one. With a
+// results file configured, every report is also written to it, along with
+// the TLS version and cipher suite receivers negotiated.
+type Collector struct {
+	cfg         *conf.Config
+	messageChan chan arrival
+	sink        Sink
+	receiver    string
+
+	clock    *clock.Estimator // nil without a sender clock
+	estimate clock.Estimate
+
+	echo    *echo.Reflector // nil without echoes
+	rtts    chan time.Duration
+	rttHalf *Recorder
+
+	relayClock    *clock.Estimator // nil without a relay clock
+	relayEstimate clock.Estimate
+
+	// Segments of the latency of messages with hops, and how many messages
+	// the wire segments left out so far and by the last report.
+	upstream        *Recorder
+	relay           *Recorder
+	downstream      *Recorder
+	hopSkipped      uint64
+	reportedSkipped uint64
+
+	rec      *Recorder
+	intended *Recorder
+	seq      *Sequence
+	count    int
+
+	// Span and volume of the measured messages, for throughput.
+	firstNanoTS int64
+	lastNanoTS  int64
+	bytes       uint64
+
+	lastReport    time.Time
+	reportedBytes uint64
+
+	tls atomic.Pointer[tls.ConnectionState] // nil without TLS
+}
+
+func NewCollector(cfg *conf.Config) (*Collector, error) {
+	c := &Collector{
+		cfg:         cfg,
+		messageChan: make(chan arrival, cfg.MessageChanSize),
+		receiver:    filepath.Base(os.Args[0]),
+		rec:         NewRecorder(),
+		intended:    NewRecorder(),
+		rttHalf:     NewRecorder(),
+		upstream:    NewRecorder(),
+		relay:       NewRecorder(),
+		downstream:  NewRecorder(),
+		seq:         NewSequence(),
+	}
+
+	metrics.NewGaugeFunc("receiver_message_chan_depth", "Messages waiting to be measured.", func() float64 {
+		return float64(len(c.messageChan))
+	})
+
+	if cfg.ClockAddr != "" {
+		est, err := clock.Dial(cfg.ClockAddr, cfg)
+		if err != nil {
+			return nil, err
+		}
+		c.clock = est
+		c.estimate = est.Estimate()
+
+		metrics.NewGaugeFunc("receiver_clock_offset_seconds", "Estimated sender minus receiver clock.", func() float64 {
+			return float64(est.Estimate().Offset) / 1e9
+		})
+		metrics.NewGaugeFunc("receiver_clock_uncertainty_seconds", "Bound of the error of the clock offset.", func() float64 {
+			return float64(est.Estimate().Uncertainty) / 1e9
+		})
+	}
+
+	if cfg.RelayClockAddr != "" {
+		est, err := clock.Dial(cfg.RelayClockAddr, cfg)
+		if err != nil {
+			return nil, err
+		}
+		c.relayClock = est
+		c.relayEstimate = est.Estimate()
+
+		metrics.NewGaugeFunc("receiver_relay_clock_offset_seconds", "Estimated relay minus receiver clock.", func() float64 {
+			return float64(est.Estimate().Offset) / 1e9
+		})
+	}
+
+	if cfg.EchoAddr != "" {
+		r, err := echo.Dial(cfg.EchoAddr)
+		if err != nil {
+			return nil, err
+		}
+		c.echo = r
+		c.rtts = make(chan time.Duration, cfg.MessageChanSize)
+	}
+
+	if cfg.ResultsFile != "" {
+		sink, err := OpenSink(cfg.ResultsFile, cfg.ResultsFormat)
+		if err != nil {
+			return nil, err
+		}
+		c.sink = sink
+	}
+
+	return c, nil
+}
+
+// SetTLS records the state of a TLS connection to the relay. Receivers
+// with several connections report the first.
+func (c *Collector) SetTLS(state tls.ConnectionState) {
+	c.tls.CompareAndSwap(nil, &state)
+}
+
+// Offer hands a message read at recvNanoTS to the collector without
+// blocking. msg must not be modified afterwards.
+func (c *Collector) Offer(msg []byte, recvNanoTS int64) {
+	c.OfferFrom(0, msg, recvNanoTS)
+}
+
+// OfferFrom is Offer for receivers with several connections; sequence
+// numbers are tracked per conn.
+func (c *Collector) OfferFrom(conn int, msg []byte, recvNanoTS int64) {
+	receivedTotal.Inc()
+
+	if c.echo != nil {
+		c.echo.Reflect(msg)
+	}
+
+	select {
+	case c.messageChan <- arrival{conn: conn, msg: msg, recvNanoTS: recvNanoTS}:
+	default:
+		droppedTotal.Inc()
+		fmt.Println("receiver chan full")
+	}
+}
+
+// Run processes offered messages until ctx is done or the configured
+// duration or message count is reached, then prints a final report.
+func (c *Collector) Run(ctx context.Context) {
+	if c.cfg.LockOSThread {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+	}
+
+	if c.cfg.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.cfg.Duration)
+		defer cancel()
+	}
+	if c.sink != nil {
+		defer c.sink.Close()
+	}
+	defer c.final()
+
+	if c.clock != nil {
+		go c.clock.Run(ctx)
+	}
+	if c.relayClock != nil {
+		go c.relayClock.Run(ctx)
+	}
+	if c.echo != nil {
+		go c.echo.Run(ctx, func(rtt time.Duration) {
+			select {
+			case c.rtts <- rtt:
+			default:
+			}
+		})
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	done := ctx.Done()
+	for {
+		if c.cfg.MessageCount > 0 && c.rec.Count() >= uint64(c.cfg.MessageCount) {
+			return
+		}
+
+		if c.cfg.UseGosched {
+			select {
+			case now := <-ticker.C:
+				c.report(now)
+			case a := <-c.messageChan:
+				c.observe(a)
+			case rtt := <-c.rtts:
+				c.observeRTT(rtt)
+			case <-done:
+				c.drain()
+				return
+			default:
+				runtime.Gosched()
+			}
+			continue
+		}
+
+		select {
+		case now := <-ticker.C:
+			c.report(now)
+		case a := <-c.messageChan:
+			c.observe(a)
+		case rtt := <-c.rtts:
+			c.observeRTT(rtt)
+		case <-done:
+			c.drain()
+			return
+		}
+	}
+}
+
+// drain observes the messages offered before Run was stopped.
+func (c *Collector) drain() {
+	for {
+		select {
+		case a := <-c.messageChan:
+			c.observe(a)
+		default:
+			return
+		}
+	}
+}
+
+func (c *Collector) observe(a arrival) {
+	env, err := envelope.Decode(a.msg)
+	if err != nil {
+		invalidTotal.Inc()
+		return
+	}
+	c.seq.Observe(StreamID{Conn: a.conn, SenderID: env.SenderID, Topic: env.Topic}, env.Seq)
+
+	c.count++
+	if c.count < c.cfg.IgnoreInitialMessageCount {
+		return
+	}
+
+	// On the sender's clock, the message arrived offset later.
+	recv := a.recvNanoTS
+	if c.clock != nil {
+		recv += c.estimate.OffsetAt(recv)
+	}
+
+	latency := time.Duration(recv - env.SendTime)
+	c.rec.Record(latency)
+	latencySecs.Observe(latency.Seconds())
+
+	if len(env.Hops) > 0 {
+		first, last := env.Hops[0], env.Hops[len(env.Hops)-1]
+		through := time.Duration(last.Egress - first.Ingress)
+		c.relay.Record(through)
+		relaySecs.Observe(through.Seconds())
+
+		// Relay timestamps are on the relay's clock. With an estimate
+		// of its offset they are moved onto the sender's clock, like
+		// recv; without, the relay is assumed to share the sender's
+		// clock, a negative segment shows it does not, and then neither
+		// is recorded.
+		ingress, egress := first.Ingress, last.Egress
+		if c.relayClock != nil {
+			shift := -c.relayEstimate.OffsetAt(a.recvNanoTS)
+			if c.clock != nil {
+				shift += c.estimate.OffsetAt(a.recvNanoTS)
+			}
+			ingress += shift
+			egress += shift
+		}
+		up := time.Duration(ingress - env.SendTime)
+		down := time.Duration(recv - egress)
+		if c.relayClock != nil || up >= 0 && down >= 0 {
+			c.upstream.Record(up)
+			c.downstream.Record(down)
+			upstreamSecs.Observe(up.Seconds())
+			downstreamSecs.Observe(down.Seconds())
+		} else {
+			c.hopSkipped++
+			hopSkewTotal.Inc()
+		}
+	}
+
+	if env.IntendedTime != 0 {
+		latency := time.Duration(recv - env.IntendedTime)
+		c.intended.Record(latency)
+		intendedSecs.Observe(latency.Seconds())
+	}
+
+	if c.firstNanoTS == 0 {
+		c.firstNanoTS = a.recvNanoTS
+	}
+	c.lastNanoTS = a.recvNanoTS
+	c.bytes += uint64(len(a.msg))
+}
+
+// printHops breaks latency down into its segments: sender to first relay,
+// first relay ingress to last relay egress, and last relay to receiver. The
+// wire segments show how many messages they left out, if any.
+func printHops(nowTimeStr string, up, relay, down Summary, skipped uint64) {
+	var suffix string
+	if skipped > 0 {
+		suffix = fmt.Sprintf(" | Skipped: %v", skipped)
+	}
+	if up.Count > 0 || skipped > 0 {
+		fmt.Printf("%v:  Upstream   | %v%v\n", nowTimeStr, up, suffix)
+	}
+	fmt.Printf("%v:  Relay      | %v\n", nowTimeStr, relay)
+	if down.Count > 0 || skipped > 0 {
+		fmt.Printf("%v:  Downstream | %v%v\n", nowTimeStr, down, suffix)
+	}
+}
+
+func (c *Collector) updateEstimates() {
+	if c.clock != nil {
+		c.estimate = c.clock.Estimate()
+	}
+	if c.relayClock != nil {
+		c.relayEstimate = c.relayClock.Estimate()
+	}
+}
+
+func (c *Collector) printClock(nowTimeStr string) {
+	if c.clock == nil {
+		return
+	}
+	fmt.Printf(
+		"%v:  Clock      | Offset: %v | Uncertainty: ±%v | Drift: %.3f ppm | Samples: %v\n",
+		nowTimeStr,
+		time.Duration(c.estimate.Offset),
+		time.Duration(c.estimate.Uncertainty),
+		c.estimate.Drift*1e6,
+		c.estimate.Samples,
+	)
+}
+
+func (c *Collector) observeRTT(rtt time.Duration) {
+	if c.count < c.cfg.IgnoreInitialMessageCount {
+		return
+	}
+	c.rttHalf.Record(rtt / 2)
+	rttHalfSecs.Observe((rtt / 2).Seconds())
+}
+
+func (c *Collector) result(now time.Time, kind string) Result {
+	r := Result{
+		Time:                 now,
+		Kind:                 kind,
+		Stack:                c.cfg.Stack,
+		Receiver:             c.receiver,
+		PayloadSize:          c.cfg.PayloadSize,
+		PayloadContent:       c.cfg.PayloadContent,
+		PayloadMinBytes:      c.cfg.PayloadMinBytes,
+		PayloadMaxBytes:      c.cfg.PayloadMaxBytes,
+		SenderThrottleMillis: c.cfg.SenderThrottleMillis,
+		SendRate:             c.cfg.SendRate,
+		SendMode:             c.cfg.SendMode,
+		ReplayFile:           c.cfg.ReplayFile,
+		ReplaySpeed:          c.cfg.ReplaySpeed,
+		UseGosched:           c.cfg.UseGosched,
+		LockOSThread:         c.cfg.LockOSThread,
+	}
+
+	if state := c.tls.Load(); state != nil {
+		r.TLSVersion = tls.VersionName(state.Version)
+		r.TLSCipherSuite = tls.CipherSuiteName(state.CipherSuite)
+		r.TLSClientAuth = c.cfg.TLSClientAuth
+	}
+	if c.clock != nil {
+		r.ClockOffsetNs = c.estimate.Offset
+		r.ClockUncertaintyNs = c.estimate.Uncertainty
+		r.ClockDriftPPM = c.estimate.Drift * 1e6
+	}
+	return r
+}
+
+func (c *Collector) write(r Result) {
+	if c.sink == nil {
+		return
+	}
+	if err := c.sink.Write(r); err != nil {
+		fmt.Println("results:", err)
+	}
+}
+
+func (c *Collector) report(now time.Time) {
+	nowTimeStr := now.Format(time.DateTime)
+	c.updateEstimates()
+	if c.count < c.cfg.IgnoreInitialMessageCount {
+		fmt.Printf(
+			"%v: Ignoring initial messages, count=%v/%v\n",
+			nowTimeStr,
+			c.count,
+			c.cfg.IgnoreInitialMessageCount,
+		)
+		return
+	}
+
+	interval, cumulative := c.rec.Rotate()
+	intendedInterval, intendedCumulative := c.intended.Rotate()
+	rttInterval, rttCumulative := c.rttHalf.Rotate()
+	upInterval, _ := c.upstream.Rotate()
+	relayInterval, relayCumulative := c.relay.Rotate()
+	downInterval, _ := c.downstream.Rotate()
+	seqInterval, seqCumulative := c.seq.Rotate()
+	lostGauge.Set(int64(seqCumulative.Lost))
+	dupGauge.Set(int64(seqCumulative.Duplicates))
+	reorderGauge.Set(int64(seqCumulative.Reordered))
+
+	fmt.Printf(
+		"%v:  Interval   | SampleLatency: %v | %v | %v | UseGosched: %v\n",
+		nowTimeStr,
+		c.rec.Last(),
+		interval,
+		seqInterval,
+		c.cfg.UseGosched,
+	)
+	fmt.Printf("%v:  Cumulative | %v | %v\n", nowTimeStr, cumulative, seqCumulative)
+	if intendedCumulative.Count > 0 {
+		fmt.Printf("%v:  Intended   | %v\n", nowTimeStr, intendedInterval)
+	}
+	if rttCumulative.Count > 0 {
+		fmt.Printf("%v:  RTT/2      | %v\n", nowTimeStr, rttInterval)
+	}
+	skipped := c.hopSkipped - c.reportedSkipped
+	if relayCumulative.Count > 0 {
+		printHops(nowTimeStr, upInterval, relayInterval, downInterval, skipped)
+	}
+	c.printClock(nowTimeStr)
+
+	if c.sink != nil {
+		elapsed := time.Second
+		if !c.lastReport.IsZero() {
+			elapsed = now.Sub(c.lastReport)
+		}
+
+		r := c.result(now, "interval")
+		r.setLatency(interval)
+		r.setIntendedLatency(intendedInterval)
+		r.setRTTHalf(rttInterval)
+		r.setHops(upInterval, relayInterval, downInterval, skipped)
+		r.setSequence(seqInterval)
+		r.setThroughput(elapsed, c.bytes-c.reportedBytes)
+		c.write(r)
+	}
+	c.lastReport = now
+	c.reportedBytes = c.bytes
+	c.reportedSkipped = c.hopSkipped
+}
+
+func (c *Collector) final() {
+	now := time.Now()
+	c.updateEstimates()
+	_, cumulative := c.rec.Rotate()
+	_, intendedCumulative := c.intended.Rotate()
+	_, rttCumulative := c.rttHalf.Rotate()
+	_, upCumulative := c.upstream.Rotate()
+	_, relayCumulative := c.relay.Rotate()
+	_, downCumulative := c.downstream.Rotate()
+	_, seqCumulative := c.seq.Rotate()
+
+	elapsed := time.Duration(c.lastNanoTS - c.firstNanoTS)
+	var msgRate, byteRate float64
+	if elapsed > 0 {
+		msgRate = float64(cumulative.Count) / elapsed.Seconds()
+		byteRate = float64(c.bytes) / elapsed.Seconds()
+	}
+
+	fmt.Printf(
+		"%v:  Final      | %v | %v | Elapsed: %v | Throughput: %.0f msg/s %.3f MB/s\n",
+		now.Format(time.DateTime),
+		cumulative,
+		seqCumulative,
+		elapsed,
+		msgRate,
+		byteRate/1e6,
+	)
+	if intendedCumulative.Count > 0 {
+		fmt.Printf("%v:  Intended   | %v\n", now.Format(time.DateTime), intendedCumulative)
+	}
+	if rttCumulative.Count > 0 {
+		fmt.Printf("%v:  RTT/2      | %v\n", now.Format(time.DateTime), rttCumulative)
+	}
+	if relayCumulative.Count > 0 {
+		printHops(now.Format(time.DateTime), upCumulative, relayCumulative, downCumulative, c.hopSkipped)
+	}
+	c.printClock(now.Format(time.DateTime))
+	if state := c.tls.Load(); state != nil {
+		fmt.Printf(
+			"%v:  TLS        | Version: %v | Cipher: %v | Mutual: %v\n",
+			now.Format(time.DateTime),
+			tls.VersionName(state.Version),
+			tls.CipherSuiteName(state.CipherSuite),
+			c.cfg.TLSClientAuth,
+		)
+	}
+
+	r := c.result(now, "final")
+	r.setLatency(cumulative)
+	r.setIntendedLatency(intendedCumulative)
+	r.setRTTHalf(rttCumulative)
+	r.setHops(upCumulative, relayCumulative, downCumulative, c.hopSkipped)
+	r.setSequence(seqCumulative)
+	r.setThroughput(elapsed, c.bytes)
+	c.write(r)
+}
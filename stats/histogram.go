@@ -0,0 +1,187 @@
+// Package stats records message latencies for the receivers.
+package stats
+
+import (
+	"math"
+	"math/bits"
+	"time"
+)
+
+// Percentiles are the quantiles every report includes.
+var Percentiles = []float64{50, 90, 99, 99.9, 99.99}
+
+// Histogram is an HDR-style log-bucketed histogram of non-negative values.
+// Each power-of-two bucket is split into linear sub-buckets so that every
+// recorded value keeps the requested number of significant decimal digits,
+// while memory stays proportional to log2 of the trackable range.
+type Histogram struct {
+	highest int64
+
+	subBucketHalfCountMagnitude int
+	subBucketHalfCount          int
+	subBucketMask               int64
+	subBucketCount              int
+
+	counts []uint64
+	total  uint64
+	sum    float64
+	min    int64
+	max    int64
+}
+
+// NewHistogram tracks values from 1 to highest with sigFigs (1-5)
+// significant decimal digits; larger values are clamped to highest.
+func NewHistogram(highest int64, sigFigs int) *Histogram {
+	if sigFigs < 1 || sigFigs > 5 {
+		panic("stats: sigFigs must be between 1 and 5")
+	}
+	if highest < 2 {
+		panic("stats: highest must be at least 2")
+	}
+
+	largestSingleUnit := 2 * int64(math.Pow10(sigFigs))
+	subBucketCountMagnitude := int(math.Ceil(math.Log2(float64(largestSingleUnit))))
+	subBucketHalfCountMagnitude := max(subBucketCountMagnitude, 1) - 1
+	subBucketCount := 1 << (subBucketHalfCountMagnitude + 1)
+
+	bucketCount := 1
+	for smallestUntrackable := int64(subBucketCount); smallestUntrackable <= highest; bucketCount++ {
+		if smallestUntrackable > math.MaxInt64/2 {
+			bucketCount++
+			break
+		}
+		smallestUntrackable <<= 1
+	}
+
+	return &Histogram{
+		highest:                     highest,
+		subBucketHalfCountMagnitude: subBucketHalfCountMagnitude,
+		subBucketHalfCount:          subBucketCount / 2,
+		subBucketMask:               int64(subBucketCount - 1),
+		subBucketCount:              subBucketCount,
+		counts:                      make([]uint64, (bucketCount+1)*(subBucketCount/2)),
+		min:                         math.MaxInt64,
+	}
+}
+
+// NewLatencyHistogram tracks latencies up to an hour with three significant digits.
+func NewLatencyHistogram() *Histogram {
+	return NewHistogram(int64(time.Hour), 3)
+}
+
+// Record adds a value, clamping it to [0, highest].
+func (h *Histogram) Record(v int64) {
+	v = min(max(v, 0), h.highest)
+
+	h.counts[h.countsIndex(v)]++
+	h.total++
+	h.sum += float64(v)
+	h.min = min(h.min, v)
+	h.max = max(h.max, v)
+}
+
+// RecordDuration is Record for a latency.
+func (h *Histogram) RecordDuration(d time.Duration) {
+	h.Record(int64(d))
+}
+
+// Merge adds every value recorded in o, which must have the same layout.
+func (h *Histogram) Merge(o *Histogram) {
+	if len(o.counts) != len(h.counts) || o.subBucketCount != h.subBucketCount {
+		panic("stats: merging histograms with different layouts")
+	}
+	if o.total == 0 {
+		return
+	}
+
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.total += o.total
+	h.sum += o.sum
+	h.min = min(h.min, o.min)
+	h.max = max(h.max, o.max)
+}
+
+func (h *Histogram) Reset() {
+	clear(h.counts)
+	h.total = 0
+	h.sum = 0
+	h.min = math.MaxInt64
+	h.max = 0
+}
+
+func (h *Histogram) Count() uint64 {
+	return h.total
+}
+
+func (h *Histogram) Min() int64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.min
+}
+
+func (h *Histogram) Max() int64 {
+	return h.max
+}
+
+func (h *Histogram) Mean() float64 {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / float64(h.total)
+}
+
+// ValueAtPercentile returns the value below which p percent of the recorded
+// values fall, within the histogram's precision.
+func (h *Histogram) ValueAtPercentile(p float64) int64 {
+	if h.total == 0 {
+		return 0
+	}
+
+	p = min(max(p, 0), 100)
+	target := max(uint64(p/100*float64(h.total)+0.5), 1)
+
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= target {
+			return min(h.highestEquivalentValue(h.valueFromIndex(i)), h.max)
+		}
+	}
+
+	return h.max
+}
+
+func (h *Histogram) bucketIndex(v int64) int {
+	return 63 - bits.LeadingZeros64(uint64(v|h.subBucketMask)) - h.subBucketHalfCountMagnitude
+}
+
+func (h *Histogram) countsIndex(v int64) int {
+	bucketIdx := h.bucketIndex(v)
+	subBucketIdx := int(v >> bucketIdx)
+	return (bucketIdx << h.subBucketHalfCountMagnitude) + subBucketIdx
+}
+
+func (h *Histogram) valueFromIndex(i int) int64 {
+	bucketIdx := (i >> h.subBucketHalfCountMagnitude) - 1
+	subBucketIdx := (i & (h.subBucketHalfCount - 1)) + h.subBucketHalfCount
+	if bucketIdx < 0 {
+		subBucketIdx -= h.subBucketHalfCount
+		bucketIdx = 0
+	}
+	return int64(subBucketIdx) << bucketIdx
+}
+
+func (h *Histogram) highestEquivalentValue(v int64) int64 {
+	bucketIdx := h.bucketIndex(v)
+	subBucketIdx := int(v >> bucketIdx)
+	lowest := int64(subBucketIdx) << bucketIdx
+
+	rangeMagnitude := bucketIdx
+	if subBucketIdx >= h.subBucketCount {
+		rangeMagnitude++
+	}
+	return lowest + (int64(1) << rangeMagnitude) - 1
+}
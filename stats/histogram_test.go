@@ -0,0 +1,145 @@
+package stats
+
+import (
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestHistogramPercentiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		values func(rng *rand.Rand) []int64
+	}{
+		{
+			name: "constant",
+			values: func(*rand.Rand) []int64 {
+				return slices.Repeat([]int64{int64(3 * time.Millisecond)}, 1000)
+			},
+		},
+		{
+			name: "linear",
+			values: func(*rand.Rand) []int64 {
+				v := make([]int64, 100_000)
+				for i := range v {
+					v[i] = int64(i + 1)
+				}
+				return v
+			},
+		},
+		{
+			name: "uniform",
+			values: func(rng *rand.Rand) []int64 {
+				v := make([]int64, 100_000)
+				for i := range v {
+					v[i] = rng.Int63n(int64(time.Second))
+				}
+				return v
+			},
+		},
+		{
+			name: "exponential",
+			values: func(rng *rand.Rand) []int64 {
+				v := make([]int64, 100_000)
+				for i := range v {
+					v[i] = int64(rng.ExpFloat64() * float64(time.Millisecond))
+				}
+				return v
+			},
+		},
+		{
+			name: "bimodal",
+			values: func(rng *rand.Rand) []int64 {
+				v := make([]int64, 100_000)
+				for i := range v {
+					v[i] = int64(50*time.Microsecond) + rng.Int63n(int64(10*time.Microsecond))
+					if i%100 == 0 {
+						v[i] = int64(20*time.Millisecond) + rng.Int63n(int64(time.Millisecond))
+					}
+				}
+				return v
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := tt.values(rand.New(rand.NewSource(1)))
+
+			h := NewLatencyHistogram()
+			for _, v := range values {
+				h.Record(v)
+			}
+
+			slices.Sort(values)
+			for _, p := range append([]float64{0, 25, 100}, Percentiles...) {
+				// The nearest-rank value, which the histogram may only
+				// round up within three significant digits.
+				rank := max(int(math.Round(p/100*float64(len(values)))), 1)
+				want := values[rank-1]
+
+				got := h.ValueAtPercentile(p)
+				if got < want || float64(got-want) > float64(want)/1000+1 {
+					t.Errorf("p%v = %v, want %v within 0.1%%", p, got, want)
+				}
+			}
+
+			if got, want := h.Count(), uint64(len(values)); got != want {
+				t.Errorf("count %v, want %v", got, want)
+			}
+			if got, want := h.Min(), values[0]; got != want {
+				t.Errorf("min %v, want %v", got, want)
+			}
+			if got, want := h.Max(), values[len(values)-1]; got != want {
+				t.Errorf("max %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestHistogramClamp(t *testing.T) {
+	h := NewHistogram(1000, 3)
+	h.Record(-5)
+	h.Record(5000)
+
+	if got := h.Min(); got != 0 {
+		t.Errorf("min %v, want 0", got)
+	}
+	if got := h.Max(); got != 1000 {
+		t.Errorf("max %v, want 1000", got)
+	}
+	if got := h.ValueAtPercentile(100); got != 1000 {
+		t.Errorf("p100 = %v, want 1000", got)
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a, b, all := NewLatencyHistogram(), NewLatencyHistogram(), NewLatencyHistogram()
+	for i := int64(1); i <= 1000; i++ {
+		v := i * int64(time.Microsecond)
+		if i%3 == 0 {
+			a.Record(v)
+		} else {
+			b.Record(v)
+		}
+		all.Record(v)
+	}
+	a.Merge(b)
+
+	if a.Count() != all.Count() || a.Min() != all.Min() || a.Max() != all.Max() || a.Mean() != all.Mean() {
+		t.Errorf("merged count %v min %v max %v mean %v, want %v %v %v %v",
+			a.Count(), a.Min(), a.Max(), a.Mean(), all.Count(), all.Min(), all.Max(), all.Mean())
+	}
+	for _, p := range Percentiles {
+		if got, want := a.ValueAtPercentile(p), all.ValueAtPercentile(p); got != want {
+			t.Errorf("merged p%v = %v, want %v", p, got, want)
+		}
+	}
+
+	a.Reset()
+	if a.Count() != 0 || a.ValueAtPercentile(50) != 0 || a.Min() != 0 {
+		t.Errorf("reset histogram count %v p50 %v min %v", a.Count(), a.ValueAtPercentile(50), a.Min())
+	}
+}
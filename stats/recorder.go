@@ -0,0 +1,84 @@
+package stats
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Summary is a snapshot of a histogram of latencies.
+type Summary struct {
+	Count       uint64
+	Min         time.Duration
+	Max         time.Duration
+	Mean        time.Duration
+	Percentiles []time.Duration // matching Percentiles
+}
+
+func (h *Histogram) Summary() Summary {
+	s := Summary{
+		Count:       h.Count(),
+		Min:         time.Duration(h.Min()),
+		Max:         time.Duration(h.Max()),
+		Mean:        time.Duration(h.Mean()),
+		Percentiles: make([]time.Duration, len(Percentiles)),
+	}
+	for i, p := range Percentiles {
+		s.Percentiles[i] = time.Duration(h.ValueAtPercentile(p))
+	}
+	return s
+}
+
+func (s Summary) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "Count: %v | Min: %v", s.Count, s.Min)
+	for i, p := range Percentiles {
+		fmt.Fprintf(&b, " | P%v: %v", p, s.Percentiles[i])
+	}
+	fmt.Fprintf(&b, " | Max: %v | Avg: %v", s.Max, s.Mean)
+
+	return b.String()
+}
+
+// Recorder tracks latencies for the current reporting interval and since start.
+type Recorder struct {
+	interval   *Histogram
+	cumulative *Histogram
+	last       time.Duration
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		interval:   NewLatencyHistogram(),
+		cumulative: NewLatencyHistogram(),
+	}
+}
+
+func (r *Recorder) Record(latency time.Duration) {
+	r.interval.RecordDuration(latency)
+	r.last = latency
+}
+
+// Last returns the most recently recorded latency.
+func (r *Recorder) Last() time.Duration {
+	return r.last
+}
+
+// Count returns the number of latencies recorded since start.
+func (r *Recorder) Count() uint64 {
+	return r.cumulative.Count() + r.interval.Count()
+}
+
+// Rotate closes the current interval, returning its summary and the
+// cumulative summary including it.
+func (r *Recorder) Rotate() (interval, cumulative Summary) {
+	r.cumulative.Merge(r.interval)
+
+	interval = r.interval.Summary()
+	cumulative = r.cumulative.Summary()
+
+	r.interval.Reset()
+
+	return interval, cumulative
+}
@@ -0,0 +1,151 @@
+package stats
+
+import "fmt"
+
+// sequenceWindow is how far behind the newest message a late arrival can
+// still be told apart from a duplicate.
+const sequenceWindow = 1024
+
+// SequenceCounts are the delivery anomalies seen by a Sequence.
+type SequenceCounts struct {
+	Received   uint64
+	Lost       uint64 // gaps not (yet) filled by late arrivals
+	Duplicates uint64
+	Reordered  uint64
+}
+
+// LossRate is the fraction of expected messages that never arrived.
+func (c SequenceCounts) LossRate() float64 {
+	expected := c.Received - c.Duplicates + c.Lost
+	if expected == 0 {
+		return 0
+	}
+	return float64(c.Lost) / float64(expected)
+}
+
+// Sub returns the counts accumulated since prev.
+func (c SequenceCounts) Sub(prev SequenceCounts) SequenceCounts {
+	return SequenceCounts{
+		Received:   c.Received - prev.Received,
+		Lost:       c.Lost - min(prev.Lost, c.Lost),
+		Duplicates: c.Duplicates - prev.Duplicates,
+		Reordered:  c.Reordered - prev.Reordered,
+	}
+}
+
+func (c SequenceCounts) String() string {
+	return fmt.Sprintf(
+		"Lost: %v | Dup: %v | Reordered: %v | LossRate: %.4f%%",
+		c.Lost,
+		c.Duplicates,
+		c.Reordered,
+		c.LossRate()*100,
+	)
+}
+
+// Sequence tracks the sequence numbers of every stream, a sender's topic
+// as seen on one connection.
+type Sequence struct {
+	streams map[StreamID]*stream
+	counts  SequenceCounts
+	last    SequenceCounts
+}
+
+// StreamID tells the streams of a Sequence apart.
+type StreamID struct {
+	Conn     int
+	SenderID uint32
+	Topic    string
+}
+
+type stream struct {
+	first   uint64 // first seq seen, earlier ones were never expected
+	highest uint64
+	lost    uint64 // this stream's share of SequenceCounts.Lost
+	seen    [sequenceWindow / 64]uint64
+}
+
+func NewSequence() *Sequence {
+	return &Sequence{
+		streams: make(map[StreamID]*stream),
+	}
+}
+
+// Observe records the arrival of seq on a stream.
+func (s *Sequence) Observe(id StreamID, seq uint64) {
+	s.counts.Received++
+
+	st, ok := s.streams[id]
+	if !ok {
+		st = &stream{first: seq, highest: seq}
+		st.mark(seq)
+		s.streams[id] = st
+		return
+	}
+
+	switch {
+	case seq > st.highest:
+		gap := seq - st.highest - 1
+		s.counts.Lost += gap
+		st.lost += gap
+		st.advance(seq)
+	case st.highest-seq >= sequenceWindow:
+		// Too old to tell; assume it fills a gap.
+		s.counts.Reordered++
+		s.fill(st, seq)
+	case st.marked(seq):
+		s.counts.Duplicates++
+	default:
+		s.counts.Reordered++
+		s.fill(st, seq)
+		st.mark(seq)
+	}
+}
+
+// fill takes a late seq off the loss of st, if it falls in a gap st
+// counted: every gap lies after its first seq.
+func (s *Sequence) fill(st *stream, seq uint64) {
+	if seq > st.first && st.lost > 0 {
+		st.lost--
+		s.counts.Lost--
+	}
+}
+
+func (s *Sequence) Counts() SequenceCounts {
+	return s.counts
+}
+
+// Rotate closes the current interval, returning its counts and the
+// cumulative counts.
+func (s *Sequence) Rotate() (interval, cumulative SequenceCounts) {
+	interval = s.counts.Sub(s.last)
+	s.last = s.counts
+	return interval, s.counts
+}
+
+func (st *stream) advance(seq uint64) {
+	if seq-st.highest >= sequenceWindow {
+		clear(st.seen[:])
+	} else {
+		for n := st.highest + 1; n < seq; n++ {
+			st.clear(n)
+		}
+	}
+	st.highest = seq
+	st.mark(seq)
+}
+
+func (st *stream) mark(seq uint64) {
+	i := seq % sequenceWindow
+	st.seen[i/64] |= 1 << (i % 64)
+}
+
+func (st *stream) clear(seq uint64) {
+	i := seq % sequenceWindow
+	st.seen[i/64] &^= 1 << (i % 64)
+}
+
+func (st *stream) marked(seq uint64) bool {
+	i := seq % sequenceWindow
+	return st.seen[i/64]&(1<<(i%64)) != 0
+}
@@ -0,0 +1,147 @@
+package stats
+
+import "testing"
+
+func TestSequence(t *testing.T) {
+	a := StreamID{Conn: 0, SenderID: 1, Topic: "a"}
+	b := StreamID{Conn: 0, SenderID: 1, Topic: "b"}
+	c := StreamID{Conn: 1, SenderID: 1, Topic: "a"}
+
+	type arrival struct {
+		id  StreamID
+		seq uint64
+	}
+	seqs := func(id StreamID, seqs ...uint64) []arrival {
+		var arrivals []arrival
+		for _, seq := range seqs {
+			arrivals = append(arrivals, arrival{id, seq})
+		}
+		return arrivals
+	}
+	concat := func(parts ...[]arrival) []arrival {
+		var arrivals []arrival
+		for _, p := range parts {
+			arrivals = append(arrivals, p...)
+		}
+		return arrivals
+	}
+
+	tests := []struct {
+		name     string
+		arrivals []arrival
+		want     SequenceCounts
+	}{
+		{
+			name:     "in order",
+			arrivals: seqs(a, 1, 2, 3, 4),
+			want:     SequenceCounts{Received: 4},
+		},
+		{
+			name:     "starting late",
+			arrivals: seqs(a, 100, 101, 102),
+			want:     SequenceCounts{Received: 3},
+		},
+		{
+			name:     "gaps",
+			arrivals: seqs(a, 1, 3, 4, 8),
+			want:     SequenceCounts{Received: 4, Lost: 4},
+		},
+		{
+			name:     "gap filled late",
+			arrivals: seqs(a, 1, 3, 2, 4),
+			want:     SequenceCounts{Received: 4, Reordered: 1},
+		},
+		{
+			name:     "duplicates",
+			arrivals: seqs(a, 1, 2, 2, 3, 1),
+			want:     SequenceCounts{Received: 5, Duplicates: 2},
+		},
+		{
+			name:     "late copy of a filled gap",
+			arrivals: seqs(a, 1, 3, 2, 2),
+			want:     SequenceCounts{Received: 4, Reordered: 1, Duplicates: 1},
+		},
+		{
+			name:     "before the first seq",
+			arrivals: seqs(a, 5, 6, 4, 3),
+			want:     SequenceCounts{Received: 4, Reordered: 2},
+		},
+		{
+			name:     "streams are independent",
+			arrivals: concat(seqs(a, 1, 2), seqs(b, 1, 2), seqs(c, 1, 2)),
+			want:     SequenceCounts{Received: 6},
+		},
+		{
+			name: "reordering does not cancel another stream's loss",
+			// a loses 2 and 3; b starts at 10 and then sees 9.
+			arrivals: concat(seqs(a, 1, 4), seqs(b, 10, 9)),
+			want:     SequenceCounts{Received: 4, Lost: 2, Reordered: 1},
+		},
+		{
+			name:     "older than the window",
+			arrivals: seqs(a, 1, 3, sequenceWindow+10, 2),
+			want:     SequenceCounts{Received: 4, Lost: sequenceWindow + 6, Reordered: 1},
+		},
+		{
+			name:     "older than the window, before the first seq",
+			arrivals: seqs(a, 500, sequenceWindow+600, 1),
+			want:     SequenceCounts{Received: 3, Lost: sequenceWindow + 99, Reordered: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewSequence()
+			for _, a := range tt.arrivals {
+				s.Observe(a.id, a.seq)
+			}
+			if got := s.Counts(); got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSequenceRotate(t *testing.T) {
+	id := StreamID{SenderID: 1}
+	s := NewSequence()
+
+	for _, seq := range []uint64{1, 2, 5} {
+		s.Observe(id, seq)
+	}
+	interval, cumulative := s.Rotate()
+	if want := (SequenceCounts{Received: 3, Lost: 2}); interval != want || cumulative != want {
+		t.Fatalf("first interval %+v, cumulative %+v, want %+v", interval, cumulative, want)
+	}
+
+	// 3 fills a gap of the first interval, which leaves this one no loss
+	// to take it off.
+	for _, seq := range []uint64{3, 6} {
+		s.Observe(id, seq)
+	}
+	interval, cumulative = s.Rotate()
+	if want := (SequenceCounts{Received: 2, Reordered: 1}); interval != want {
+		t.Errorf("second interval %+v, want %+v", interval, want)
+	}
+	if want := (SequenceCounts{Received: 5, Lost: 1, Reordered: 1}); cumulative != want {
+		t.Errorf("cumulative %+v, want %+v", cumulative, want)
+	}
+}
+
+func TestSequenceCountsLossRate(t *testing.T) {
+	tests := []struct {
+		counts SequenceCounts
+		want   float64
+	}{
+		{SequenceCounts{}, 0},
+		{SequenceCounts{Received: 10}, 0},
+		{SequenceCounts{Received: 3, Lost: 1}, 0.25},
+		{SequenceCounts{Received: 5, Duplicates: 2, Lost: 1}, 0.25},
+	}
+
+	for _, tt := range tests {
+		if got := tt.counts.LossRate(); got != tt.want {
+			t.Errorf("%+v: loss rate %v, want %v", tt.counts, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package stats
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Result is the machine-readable form of a Collector report. Durations are
+// in nanoseconds.
+type Result struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"` // "interval" or "final"
+	Stack    string    `json:"stack"`
+	Receiver string    `json:"receiver"`
+
+	PayloadSize          string  `json:"payload_size"`
+	PayloadContent       string  `json:"payload_content"`
+	PayloadMinBytes      int     `json:"payload_min_bytes"`
+	PayloadMaxBytes      int     `json:"payload_max_bytes"`
+	SenderThrottleMillis int     `json:"sender_throttle_millis"`
+	SendRate             float64 `json:"send_rate"`
+	SendMode             string  `json:"send_mode"`
+	ReplayFile           string  `json:"replay_file"`
+	ReplaySpeed          float64 `json:"replay_speed"`
+	UseGosched           bool    `json:"use_gosched"`
+	LockOSThread         bool    `json:"lock_os_thread"`
+
+	// Negotiated with the relay, empty without TLS.
+	TLSVersion     string `json:"tls_version"`
+	TLSCipherSuite string `json:"tls_cipher_suite"`
+	TLSClientAuth  bool   `json:"tls_client_auth"`
+
+	Count   uint64 `json:"count"`
+	MinNs   int64  `json:"min_ns"`
+	P50Ns   int64  `json:"p50_ns"`
+	P90Ns   int64  `json:"p90_ns"`
+	P99Ns   int64  `json:"p99_ns"`
+	P999Ns  int64  `json:"p99_9_ns"`
+	P9999Ns int64  `json:"p99_99_ns"`
+	MaxNs   int64  `json:"max_ns"`
+	MeanNs  int64  `json:"mean_ns"`
+
+	// Latency from the intended send time of open-loop senders, zero
+	// without them.
+	IntendedCount   uint64 `json:"intended_count"`
+	IntendedMinNs   int64  `json:"intended_min_ns"`
+	IntendedP50Ns   int64  `json:"intended_p50_ns"`
+	IntendedP90Ns   int64  `json:"intended_p90_ns"`
+	IntendedP99Ns   int64  `json:"intended_p99_ns"`
+	IntendedP999Ns  int64  `json:"intended_p99_9_ns"`
+	IntendedP9999Ns int64  `json:"intended_p99_99_ns"`
+	IntendedMaxNs   int64  `json:"intended_max_ns"`
+	IntendedMeanNs  int64  `json:"intended_mean_ns"`
+
+	// Half the round trips of echoed messages, zero without echoes.
+	RTTHalfCount   uint64 `json:"rtt_half_count"`
+	RTTHalfMinNs   int64  `json:"rtt_half_min_ns"`
+	RTTHalfP50Ns   int64  `json:"rtt_half_p50_ns"`
+	RTTHalfP90Ns   int64  `json:"rtt_half_p90_ns"`
+	RTTHalfP99Ns   int64  `json:"rtt_half_p99_ns"`
+	RTTHalfP999Ns  int64  `json:"rtt_half_p99_9_ns"`
+	RTTHalfP9999Ns int64  `json:"rtt_half_p99_99_ns"`
+	RTTHalfMaxNs   int64  `json:"rtt_half_max_ns"`
+	RTTHalfMeanNs  int64  `json:"rtt_half_mean_ns"`
+
+	// Latency segments of messages stamped by relays, zero without hops:
+	// sender to relay, through the relays, and relay to receiver. The wire
+	// segments place relay timestamps with the estimated relay clock, or
+	// else assume the relays share the sender's clock; messages on which
+	// that gives a negative segment are then left out of both, and counted.
+	UpstreamP50Ns   int64  `json:"upstream_p50_ns"`
+	UpstreamP99Ns   int64  `json:"upstream_p99_ns"`
+	UpstreamMaxNs   int64  `json:"upstream_max_ns"`
+	RelayP50Ns      int64  `json:"relay_p50_ns"`
+	RelayP99Ns      int64  `json:"relay_p99_ns"`
+	RelayMaxNs      int64  `json:"relay_max_ns"`
+	DownstreamP50Ns int64  `json:"downstream_p50_ns"`
+	DownstreamP99Ns int64  `json:"downstream_p99_ns"`
+	DownstreamMaxNs int64  `json:"downstream_max_ns"`
+	HopSkipped      uint64 `json:"hop_skipped"`
+
+	// Estimated sender minus receiver clock the latencies were corrected
+	// by, zero without a sender clock.
+	ClockOffsetNs      int64   `json:"clock_offset_ns"`
+	ClockUncertaintyNs int64   `json:"clock_uncertainty_ns"`
+	ClockDriftPPM      float64 `json:"clock_drift_ppm"`
+
+	Received   uint64  `json:"received"`
+	Lost       uint64  `json:"lost"`
+	Duplicates uint64  `json:"duplicates"`
+	Reordered  uint64  `json:"reordered"`
+	LossRate   float64 `json:"loss_rate"`
+
+	ElapsedNs int64   `json:"elapsed_ns"`
+	Bytes     uint64  `json:"bytes"`
+	MsgPerSec float64 `json:"msg_per_sec"`
+	MBPerSec  float64 `json:"mb_per_sec"`
+}
+
+func (r *Result) setLatency(s Summary) {
+	r.Count = s.Count
+	r.MinNs = int64(s.Min)
+	r.MaxNs = int64(s.Max)
+	r.MeanNs = int64(s.Mean)
+
+	for i, p := range Percentiles {
+		v := int64(s.Percentiles[i])
+		switch p {
+		case 50:
+			r.P50Ns = v
+		case 90:
+			r.P90Ns = v
+		case 99:
+			r.P99Ns = v
+		case 99.9:
+			r.P999Ns = v
+		case 99.99:
+			r.P9999Ns = v
+		}
+	}
+}
+
+func (r *Result) setIntendedLatency(s Summary) {
+	var l Result
+	l.setLatency(s)
+
+	r.IntendedCount = l.Count
+	r.IntendedMinNs = l.MinNs
+	r.IntendedP50Ns = l.P50Ns
+	r.IntendedP90Ns = l.P90Ns
+	r.IntendedP99Ns = l.P99Ns
+	r.IntendedP999Ns = l.P999Ns
+	r.IntendedP9999Ns = l.P9999Ns
+	r.IntendedMaxNs = l.MaxNs
+	r.IntendedMeanNs = l.MeanNs
+}
+
+func (r *Result) setRTTHalf(s Summary) {
+	var l Result
+	l.setLatency(s)
+
+	r.RTTHalfCount = l.Count
+	r.RTTHalfMinNs = l.MinNs
+	r.RTTHalfP50Ns = l.P50Ns
+	r.RTTHalfP90Ns = l.P90Ns
+	r.RTTHalfP99Ns = l.P99Ns
+	r.RTTHalfP999Ns = l.P999Ns
+	r.RTTHalfP9999Ns = l.P9999Ns
+	r.RTTHalfMaxNs = l.MaxNs
+	r.RTTHalfMeanNs = l.MeanNs
+}
+
+func (r *Result) setHops(up, relay, down Summary, skipped uint64) {
+	var l Result
+
+	l.setLatency(up)
+	r.UpstreamP50Ns, r.UpstreamP99Ns, r.UpstreamMaxNs = l.P50Ns, l.P99Ns, l.MaxNs
+	l.setLatency(relay)
+	r.RelayP50Ns, r.RelayP99Ns, r.RelayMaxNs = l.P50Ns, l.P99Ns, l.MaxNs
+	l.setLatency(down)
+	r.DownstreamP50Ns, r.DownstreamP99Ns, r.DownstreamMaxNs = l.P50Ns, l.P99Ns, l.MaxNs
+	r.HopSkipped = skipped
+}
+
+func (r *Result) setSequence(c SequenceCounts) {
+	r.Received = c.Received
+	r.Lost = c.Lost
+	r.Duplicates = c.Duplicates
+	r.Reordered = c.Reordered
+	r.LossRate = c.LossRate()
+}
+
+func (r *Result) setThroughput(elapsed time.Duration, bytes uint64) {
+	r.ElapsedNs = int64(elapsed)
+	r.Bytes = bytes
+	if elapsed > 0 {
+		r.MsgPerSec = float64(r.Count) / elapsed.Seconds()
+		r.MBPerSec = float64(bytes) / elapsed.Seconds() / 1e6
+	}
+}
+
+// Sink receives the results of a Collector.
+type Sink interface {
+	Write(r Result) error
+	Close() error
+}
+
+// OpenSink opens a results file for appending, so the runs of a benchmark
+// can share it. format is "jsonl" or "csv". A CSV file must be empty or have
+// the header of this version's results, whose columns would not line up
+// with an older one's.
+func OpenSink(path, format string) (Sink, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case "jsonl":
+		return NewJSONSink(f), nil
+	case "csv":
+		// Reads start at the beginning of the file, writes append.
+		header, err := csv.NewReader(f).Read()
+		if err == io.EOF {
+			return newCSVSink(f, true), nil
+		}
+		if err == nil && !slices.Equal(header, csvHeader()) {
+			err = fmt.Errorf("results file %v has other columns than this version writes, use a new file", path)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return newCSVSink(f, false), nil
+	default:
+		f.Close()
+		return nil, fmt.Errorf("unknown results format %q", format)
+	}
+}
+
+// NewJSONSink writes one JSON object per result and line.
+func NewJSONSink(w io.WriteCloser) Sink {
+	return &jsonSink{w: w, enc: json.NewEncoder(w)}
+}
+
+type jsonSink struct {
+	w   io.WriteCloser
+	enc *json.Encoder
+}
+
+func (s *jsonSink) Write(r Result) error {
+	return s.enc.Encode(r)
+}
+
+func (s *jsonSink) Close() error {
+	return s.w.Close()
+}
+
+// NewCSVSink writes one row per result, after a header row of the JSON
+// field names.
+func NewCSVSink(w io.WriteCloser) Sink {
+	return newCSVSink(w, true)
+}
+
+type csvSink struct {
+	w          io.WriteCloser
+	csv        *csv.Writer
+	needHeader bool
+}
+
+func newCSVSink(w io.WriteCloser, header bool) *csvSink {
+	return &csvSink{w: w, csv: csv.NewWriter(w), needHeader: header}
+}
+
+func (s *csvSink) Write(r Result) error {
+	if s.needHeader {
+		if err := s.csv.Write(csvHeader()); err != nil {
+			return err
+		}
+		s.needHeader = false
+	}
+
+	v := reflect.ValueOf(r)
+	row := make([]string, v.NumField())
+	for i := range row {
+		switch f := v.Field(i).Interface().(type) {
+		case time.Time:
+			row[i] = f.Format(time.RFC3339Nano)
+		case float64:
+			row[i] = strconv.FormatFloat(f, 'g', -1, 64)
+		default:
+			row[i] = fmt.Sprint(f)
+		}
+	}
+	if err := s.csv.Write(row); err != nil {
+		return err
+	}
+
+	// Flush every row so an interrupted run keeps its results.
+	s.csv.Flush()
+	return s.csv.Error()
+}
+
+// csvHeader returns the JSON field names of Result, one column each.
+func csvHeader() []string {
+	t := reflect.TypeFor[Result]()
+	header := make([]string, t.NumField())
+	for i := range header {
+		header[i] = t.Field(i).Tag.Get("json")
+	}
+	return header
+}
+
+func (s *csvSink) Close() error {
+	s.csv.Flush()
+	return s.w.Close()
+}
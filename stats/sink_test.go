@@ -0,0 +1,77 @@
+package stats
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOpenSinkCSV(t *testing.T) {
+	header := strings.Join(csvHeader(), ",") + "\n"
+
+	tests := []struct {
+		name    string
+		exists  bool
+		content string
+		rows    int // rows after the header once a result is appended
+		wantErr bool
+	}{
+		{name: "new file", rows: 1},
+		{name: "empty file", exists: true, rows: 1},
+		{name: "same header", exists: true, content: header, rows: 1},
+		{name: "same header and rows", exists: true, content: header + strings.Repeat(",", len(csvHeader())-1) + "\n", rows: 2},
+		{name: "older header", exists: true, content: "time,kind,count\n", wantErr: true},
+		{name: "not csv", exists: true, content: "\"unterminated\n", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "results.csv")
+			if tt.exists {
+				if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sink, err := OpenSink(path, "csv")
+			if tt.wantErr {
+				if err == nil {
+					sink.Close()
+					t.Fatal("appended to a file with other columns")
+				}
+				if b, _ := os.ReadFile(path); string(b) != tt.content {
+					t.Errorf("file changed to %q", b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Write(Result{Kind: "final", Count: 3}); err != nil {
+				t.Fatal(err)
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			records, err := csv.NewReader(f).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != tt.rows+1 || !slices.Equal(records[0], csvHeader()) {
+				t.Fatalf("got %v records, want a header and %v rows", len(records), tt.rows)
+			}
+			if last := records[len(records)-1]; last[1] != "final" {
+				t.Errorf("appended row %v", last)
+			}
+		})
+	}
+}
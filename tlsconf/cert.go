@@ -0,0 +1,126 @@
+package tlsconf
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Hosts are the names local certificates are valid for.
+var Hosts = []string{"localhost", "127.0.0.1", "::1"}
+
+const validity = 30 * 24 * time.Hour
+
+// Files are the paths Generate wrote.
+type Files struct {
+	CA, Cert, Key string
+}
+
+// Generate writes a CA and a certificate it signed for hosts to dir, as
+// ca.pem, cert.pem and key.pem. The certificate serves both listeners and
+// dialers, so every role of a local run, mTLS included, can share it.
+func Generate(dir string, hosts []string) (Files, error) {
+	ca, caKey, err := newCert(nil, true, nil, nil)
+	if err != nil {
+		return Files{}, err
+	}
+	cert, key, err := newCert(hosts, false, ca, caKey)
+	if err != nil {
+		return Files{}, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return Files{}, err
+	}
+
+	f := Files{
+		CA:   filepath.Join(dir, "ca.pem"),
+		Cert: filepath.Join(dir, "cert.pem"),
+		Key:  filepath.Join(dir, "key.pem"),
+	}
+	for _, w := range []struct {
+		path, typ string
+		der       []byte
+		perm      os.FileMode
+	}{
+		{f.CA, "CERTIFICATE", ca.Raw, 0o644},
+		{f.Cert, "CERTIFICATE", cert.Raw, 0o644},
+		{f.Key, "EC PRIVATE KEY", keyDER, 0o600},
+	} {
+		b := pem.EncodeToMemory(&pem.Block{Type: w.typ, Bytes: w.der})
+		if err := os.WriteFile(w.path, b, w.perm); err != nil {
+			return Files{}, err
+		}
+	}
+	return f, nil
+}
+
+// selfSigned returns a certificate for Hosts signed by itself.
+func selfSigned() (tls.Certificate, error) {
+	cert, key, err := newCert(Hosts, false, nil, nil)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{cert.Raw}, PrivateKey: key, Leaf: cert}, nil
+}
+
+// newCert creates a CA, or a certificate for hosts, signed by parent or by
+// itself when parent is nil.
+func newCert(hosts []string, ca bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{"go-relay"}, CommonName: "go-relay CA"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+
+		BasicConstraintsValid: true,
+	}
+	if ca {
+		tmpl.IsCA = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		tmpl.Subject.CommonName = hosts[0]
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		for _, h := range hosts {
+			if ip := net.ParseIP(h); ip != nil {
+				tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+			} else {
+				tmpl.DNSNames = append(tmpl.DNSNames, h)
+			}
+		}
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
@@ -0,0 +1,202 @@
+package tlsconf
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Front terminates TLS for a server that cannot, such as a gev loop: it
+// accepts TLS connections and forwards their plaintext to the server over
+// loopback. Latencies through it include the extra loopback hop, as they
+// would behind a TLS-terminating proxy, so they are not directly comparable
+// with stacks that terminate TLS themselves.
+//
+// The backend is plain TCP that any local process can dial, so the server
+// must close connections that did not come through the front, see
+// Forwarded; otherwise they would skip TLS and client certificates.
+type Front struct {
+	// Backend is the loopback address the server should listen on.
+	Backend string
+
+	ln       net.Listener
+	reserved int // socket holding Backend
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	done     bool
+	peers    map[string]bool // local addresses of forwarded connections
+}
+
+// Listen starts accepting TLS connections on addr and reserves the backend
+// address, which the server must listen on before clients arrive.
+func Listen(addr string, config *tls.Config) (*Front, error) {
+	backend, reserved, err := reserveLoopback()
+	if err != nil {
+		return nil, err
+	}
+	ln, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		unix.Close(reserved)
+		return nil, err
+	}
+
+	f := &Front{Backend: backend, ln: ln, reserved: reserved, peers: make(map[string]bool)}
+	f.wg.Add(1)
+	go f.serve()
+	return f, nil
+}
+
+func (f *Front) serve() {
+	defer f.wg.Done()
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			f.mu.Lock()
+			done := f.done
+			f.mu.Unlock()
+			if !done {
+				log.Println("tls front:", err)
+			}
+			return
+		}
+		go f.forward(conn)
+	}
+}
+
+// forward completes the handshake, so a rejected client never reaches the
+// server, then copies both ways until either side closes.
+func (f *Front) forward(conn net.Conn) {
+	defer conn.Close()
+
+	if err := conn.(*tls.Conn).Handshake(); err != nil {
+		if err != io.EOF {
+			log.Printf("tls front: %v: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	backend, err := f.dial()
+	if err != nil {
+		log.Println("tls front:", err)
+		return
+	}
+	defer backend.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = io.Copy(backend, conn)
+		_ = backend.(*forwardedConn).Conn.(*net.TCPConn).CloseWrite()
+	}()
+	_, _ = io.Copy(conn, backend)
+	_ = conn.Close()
+	<-done
+}
+
+// dial connects to the backend from an address recorded before the
+// connection is made, so the server can tell it from others the moment it
+// accepts it.
+func (f *Front) dial() (net.Conn, error) {
+	var local string
+	d := net.Dialer{Control: func(_, _ string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			err = unix.Bind(int(fd), &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+			var sa unix.Sockaddr
+			if err == nil {
+				sa, err = unix.Getsockname(int(fd))
+			}
+			if err == nil {
+				local = net.JoinHostPort("127.0.0.1", strconv.Itoa(sa.(*unix.SockaddrInet4).Port))
+				f.mu.Lock()
+				f.peers[local] = true
+				f.mu.Unlock()
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+
+	conn, err := d.Dial("tcp4", f.Backend)
+	if err != nil {
+		f.forget(local)
+		return nil, err
+	}
+	return &forwardedConn{Conn: conn, f: f, local: local}, nil
+}
+
+func (f *Front) forget(local string) {
+	f.mu.Lock()
+	delete(f.peers, local)
+	f.mu.Unlock()
+}
+
+// Forwarded tells whether a connection the server accepted from peer came
+// through the front. Servers behind a front close the others.
+func (f *Front) Forwarded(peer string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.peers[peer]
+}
+
+// forwardedConn forgets its address once closed.
+type forwardedConn struct {
+	net.Conn
+	f     *Front
+	local string
+}
+
+func (c *forwardedConn) Close() error {
+	c.f.forget(c.local)
+	return c.Conn.Close()
+}
+
+// Close stops accepting connections; open ones end as the server closes
+// them.
+func (f *Front) Close() error {
+	f.mu.Lock()
+	f.done = true
+	f.mu.Unlock()
+
+	err := f.ln.Close()
+	f.wg.Wait()
+	unix.Close(f.reserved)
+	return err
+}
+
+// reserveLoopback binds a socket to a free loopback port with SO_REUSEADDR
+// and returns its address. The socket never listens, so it takes no
+// connections, and a listener with SO_REUSEADDR, as net.Listen sets, can
+// still bind the port; nothing without SO_REUSEADDR can take it meanwhile.
+// Once the server listens, no other socket can bind the port, as the server
+// does not set SO_REUSEPORT.
+func reserveLoopback() (string, int, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return "", -1, err
+	}
+	unix.CloseOnExec(fd)
+
+	err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+	if err == nil {
+		err = unix.Bind(fd, &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}})
+	}
+	var sa unix.Sockaddr
+	if err == nil {
+		sa, err = unix.Getsockname(fd)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return "", -1, err
+	}
+
+	port := sa.(*unix.SockaddrInet4).Port
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), fd, nil
+}
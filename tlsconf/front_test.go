@@ -0,0 +1,190 @@
+package tlsconf
+
+import (
+	"bufio"
+	"crypto/tls"
+	"go-relay/cmd/conf"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestReserveLoopback(t *testing.T) {
+	addr, fd, err := reserveLoopback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(fd)
+
+	// A socket without SO_REUSEADDR cannot take the reserved port.
+	other, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(other)
+	sa, _ := unix.Getsockname(fd)
+	if err := unix.Bind(other, sa); err == nil {
+		t.Fatalf("bound reserved %v without SO_REUSEADDR", addr)
+	}
+
+	// net.Listen, as gev uses, can.
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("listen on reserved %v: %v", addr, err)
+	}
+	defer ln.Close()
+
+	// Once the server listens, nothing else binds the port.
+	if ln2, err := net.Listen("tcp", addr); err == nil {
+		ln2.Close()
+		t.Fatalf("listened twice on %v", addr)
+	}
+
+	// The reservation never listens, so every connection reaches ln.
+	for range 10 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		accepted, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		accepted.Close()
+	}
+}
+
+func TestFront(t *testing.T) {
+	files, err := Generate(t.TempDir(), Hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := conf.Default()
+	cfg.TLS = true
+	cfg.TLSCert, cfg.TLSKey, cfg.TLSCA = files.Cert, files.Key, files.CA
+	cfg.TLSClientAuth = true
+
+	serverTLS, err := Server(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	front, err := Listen("127.0.0.1:0", serverTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+
+	// The backend answers every line with its upper case, after telling
+	// whether the connection came through the front.
+	ln, err := net.Listen("tcp", front.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan bool, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- front.Forwarded(conn.RemoteAddr().String())
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadBytes('\n')
+					if err != nil {
+						return
+					}
+					for i, b := range line {
+						if 'a' <= b && b <= 'z' {
+							line[i] = b - 'a' + 'A'
+						}
+					}
+					if _, err := conn.Write(line); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	clientTLS, err := Client(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := front.ln.Addr().String()
+
+	t.Run("forwards both ways", func(t *testing.T) {
+		conn, err := tls.Dial("tcp", addr, clientTLS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		if _, err := conn.Write([]byte("ping\n")); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "PING\n" {
+			t.Fatalf("read %q, %v, want PING", line, err)
+		}
+
+		select {
+		case forwarded := <-accepted:
+			if !forwarded {
+				t.Error("front connection not Forwarded")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("backend accepted nothing")
+		}
+	})
+
+	t.Run("rejects clients without a certificate", func(t *testing.T) {
+		noCert := clientTLS.Clone()
+		noCert.Certificates = nil
+
+		conn, err := tls.Dial("tcp", addr, noCert)
+		if err == nil {
+			// TLS 1.3 clients learn of the rejection on their first read.
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+		if err == nil || err == io.EOF {
+			t.Fatalf("read %v, want a handshake error", err)
+		}
+
+		select {
+		case <-accepted:
+			t.Fatal("rejected client reached the backend")
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+
+	t.Run("tells direct connections apart", func(t *testing.T) {
+		conn, err := net.Dial("tcp", front.Backend)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		select {
+		case forwarded := <-accepted:
+			if forwarded {
+				t.Error("direct connection Forwarded")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("backend accepted nothing")
+		}
+	})
+}
@@ -0,0 +1,98 @@
+// Package tlsconf builds the TLS configs of the websocket roles from the
+// config, and generates certificates for local runs.
+package tlsconf
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"go-relay/cmd/conf"
+	"log"
+	"os"
+)
+
+var versions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Server returns the config of listeners, or nil without TLS. Without a
+// certificate, it serves a self-signed one that dialers need tls-insecure
+// to accept.
+func Server(cfg *conf.Config) (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+
+	var cert tls.Certificate
+	var err error
+	if cfg.TLSCert != "" {
+		cert, err = tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+	} else {
+		log.Println("tls: no tls-cert, serving a self-signed certificate")
+		cert, err = selfSigned()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   versions[cfg.TLSVersion],
+	}
+	if cfg.TLSClientAuth {
+		// Checked here rather than by the config, since bench generates
+		// the CA of its roles.
+		if cfg.TLSCA == "" {
+			return nil, errors.New("tls-client-auth needs tls-ca")
+		}
+		if c.ClientCAs, err = loadPool(cfg.TLSCA); err != nil {
+			return nil, err
+		}
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return c, nil
+}
+
+// Client returns the config of dialers, or nil without TLS. Dialers present
+// tls-cert when it is set, for listeners that require client certificates.
+func Client(cfg *conf.Config) (*tls.Config, error) {
+	if !cfg.TLS {
+		return nil, nil
+	}
+
+	c := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		MaxVersion:         versions[cfg.TLSVersion],
+		InsecureSkipVerify: cfg.TLSInsecure,
+	}
+	if cfg.TLSCA != "" {
+		pool, err := loadPool(cfg.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		c.RootCAs = pool
+	}
+	if cfg.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return nil, err
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return c, nil
+}
+
+func loadPool(path string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%v: no PEM certificates", path)
+	}
+	return pool, nil
+}